@@ -0,0 +1,67 @@
+package bitcask
+
+import (
+	"time"
+
+	"github.com/nireo/bitcask/datafile"
+)
+
+// Batch collects multiple writes that are applied atomically with DB.Write. Either all of the
+// writes in the batch are visible after a crash or none of them are.
+type Batch struct {
+	entries []*datafile.Entry
+}
+
+// NewBatch creates an empty batch.
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// Put adds a key-value pair into the batch. The key and the value are copied, so the caller can
+// reuse the buffers.
+func (b *Batch) Put(key, value []byte) {
+	b.entries = append(b.entries, &datafile.Entry{
+		Key:   append([]byte(nil), key...),
+		Value: append([]byte(nil), value...),
+		Batch: true,
+	})
+}
+
+// Delete adds the deletion of a key into the batch.
+func (b *Batch) Delete(key []byte) {
+	b.entries = append(b.entries, &datafile.Entry{
+		Key:       append([]byte(nil), key...),
+		Tombstone: true,
+		Batch:     true,
+	})
+}
+
+// Len returns the amount of writes in the batch.
+func (b *Batch) Len() int {
+	return len(b.entries)
+}
+
+// Reset removes all of the writes from the batch such that it can be reused.
+func (b *Batch) Reset() {
+	b.entries = nil
+}
+
+// Write applies all of the writes in the batch atomically. The entries are written into the datafile
+// with a single write followed by a commit entry. If the database crashes before the commit entry is
+// on the disk, none of the writes are applied when the database is opened again.
+func (db *DB) Write(b *Batch) error {
+	if len(b.entries) == 0 {
+		return nil
+	}
+
+	timestamp := uint32(time.Now().Unix())
+	entries := make([]*datafile.Entry, 0, len(b.entries)+1)
+	for _, entry := range b.entries {
+		e := *entry
+		e.Timestamp = timestamp
+		entries = append(entries, &e)
+	}
+	entries = append(entries, datafile.CommitEntry(len(b.entries), timestamp))
+
+	return db.write(entries)
+}
@@ -1,16 +1,23 @@
 package bitcask
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/nireo/bitcask/cache"
+	"github.com/nireo/bitcask/compress"
 	"github.com/nireo/bitcask/datafile"
+	"github.com/nireo/bitcask/encoder"
+	"github.com/nireo/bitcask/encryption"
 	"github.com/nireo/bitcask/hint"
 	"github.com/nireo/bitcask/keydir"
 	"github.com/nireo/bitcask/utils"
@@ -19,18 +26,179 @@ import (
 const (
 	// MaxDatafileSize is 512 mb by default.
 	MaxDatafileSize int64 = 512 * 1024 * 1024
+
+	// FragMergeTrigger is the percentage of dead entries in a datafile that causes it to be merged.
+	FragMergeTrigger = 60
+
+	// DeadBytesMergeTrigger is the amount of dead bytes in a datafile that causes it to be merged.
+	DeadBytesMergeTrigger int64 = 512 * 1024 * 1024
+
+	// MergeCheckInterval is how often the datafiles are checked for merging by default.
+	MergeCheckInterval = 3 * time.Minute
+
+	// SyncInterval is how often the writable datafile is synced to disk by default.
+	SyncInterval = time.Second
+
+	// ExpirySweepInterval is how often the expired keys are removed from the key directory by
+	// default.
+	ExpirySweepInterval = time.Minute
+
+	// CompressionThreshold is the size of the smallest value that is compressed by default.
+	CompressionThreshold = 128
+
+	// MaxKeySize is the size of the largest key that can be written by default.
+	MaxKeySize = 64 * 1024
+
+	// MaxValueSize is the size of the largest value that can be written by default.
+	MaxValueSize = 64 * 1024 * 1024
+)
+
+// SyncPolicy decides when the writes are flushed to the disk with fsync.
+type SyncPolicy int
+
+const (
+	// SyncNever leaves flushing the writes to the operating system. DB.Sync can still be called
+	// manually.
+	SyncNever SyncPolicy = iota
+
+	// SyncAlways syncs the datafile after every write. A Put that has returned can't be lost,
+	// but every write has to wait for the disk.
+	SyncAlways
+
+	// SyncEveryInterval syncs the writable datafile in the background every Options.SyncInterval. At
+	// most the writes made during the last interval can be lost.
+	SyncEveryInterval
+)
+
+// IndexType decides how the key directory stores the keys in memory.
+type IndexType int
+
+const (
+	// HashIndex stores the keys in a hash map. It has the fastest point lookups, but ordered
+	// iteration needs to sort the keys.
+	HashIndex IndexType = iota
+
+	// OrderedIndex keeps the keys in sorted order, so Range, Prefix and Seek don't need to sort
+	// all of the keys.
+	OrderedIndex
+
+	// CompactIndex packs the keys and their metadata into large arenas without any per-key
+	// allocations. It is meant for databases with a very large amount of keys.
+	CompactIndex
+)
+
+var (
+	ErrMergeInProgress = errors.New("a merge is already in progress")
+	ErrNotReadOnly     = errors.New("the datafile is not a read-only datafile")
+	ErrCorrupted       = errors.New("the entry in the datafile is corrupted")
+	ErrKeyNotFound     = errors.New("could not find value from keydir")
+	ErrInvalidCodec    = errors.New("the codec of the compressor is not between 1 and 7")
+	ErrUnknownCodec    = errors.New("no compressor found for the codec of the value")
 )
 
+// CorruptedError is returned when an entry read from a datafile doesn't match its checksum. It
+// matches ErrCorrupted when used with errors.Is.
+type CorruptedError struct {
+	FileID uint32
+	Offset int64
+}
+
+func (e *CorruptedError) Error() string {
+	return fmt.Sprintf("%s: file %d offset %d", ErrCorrupted, e.FileID, e.Offset)
+}
+
+// Is makes errors.Is(err, ErrCorrupted) work.
+func (e *CorruptedError) Is(target error) bool {
+	return target == ErrCorrupted
+}
+
 // Options represents the configuration the user can do.
 type Options struct {
 	MaxDatafileSize int64
+
+	// FragMergeTrigger is the percentage (0-100) of the datafile that has to be dead bytes for the
+	// datafile to be merged in the background. Zero disables this trigger.
+	FragMergeTrigger int
+
+	// DeadBytesMergeTrigger is the amount of dead bytes a datafile needs to have for it to be merged
+	// in the background. Zero disables this trigger.
+	DeadBytesMergeTrigger int64
+
+	// MergeCheckInterval is how often the background compaction checks the datafiles. Zero disables
+	// background compaction.
+	MergeCheckInterval time.Duration
+
+	// VerifyChecksums makes Get read the whole entry and check its crc32 checksum instead of
+	// reading only the value.
+	VerifyChecksums bool
+
+	// SyncPolicy decides when the writes are synced to the disk. The hint files are only synced
+	// when the datafile is rotated or closed, since they can be rebuilt from the datafile.
+	SyncPolicy SyncPolicy
+
+	// SyncInterval is how often the writes are synced when SyncPolicy is SyncEveryInterval. The
+	// SyncInterval constant is used if it is zero.
+	SyncInterval time.Duration
+
+	// Index decides how the keys are stored in memory. The hash index is used by default.
+	Index IndexType
+
+	// MmapReads memory-maps the read-only datafiles such that the values can be read without
+	// system calls. The writable datafile is still read with pread.
+	MmapReads bool
+
+	// ValueCacheBytes is the amount of memory used to cache recently read values. Zero disables
+	// the cache.
+	ValueCacheBytes int64
+
+	// ExpirySweepInterval is how often the keys written with PutWithTTL are checked and removed
+	// from the key directory once they have expired. Zero disables the background sweeping, but the
+	// expired keys are still not found.
+	ExpirySweepInterval time.Duration
+
+	// Compression compresses the values that are at least CompressionThreshold bytes long. The
+	// values are not compressed if it is nil. The values compressed with the built-in compressors
+	// can always be read, but a custom compressor is needed to read the values it has compressed.
+	Compression compress.Compressor
+
+	// CompressionThreshold is the size of the smallest value that is compressed.
+	CompressionThreshold int
+
+	// EncryptionKey encrypts the keys and values of the new datafiles and hint files with AES-GCM.
+	// It needs to be 16, 24 or 32 bytes long. The files are not encrypted if it is nil.
+	EncryptionKey []byte
+
+	// OldEncryptionKeys are used to read the datafiles encrypted with earlier keys. Merging
+	// rewrites the datafiles with EncryptionKey, so after a full Merge the old keys are not needed
+	// anymore.
+	OldEncryptionKeys [][]byte
+
+	// MaxKeySize is the size of the largest key that can be written. Writing a larger key returns
+	// ErrKeyTooLarge. Zero means that only the limit of the entry format applies, which is about
+	// 4 GB for the key and the value together.
+	MaxKeySize int
+
+	// MaxValueSize is the size of the largest value that can be written. Writing a larger value
+	// returns ErrValueTooLarge. Zero means that only the limit of the entry format applies.
+	MaxValueSize int
 }
 
 // DefaultConfiguration just returns the default options used by the database if
 // the database options are not set by the user.
 func DefaultConfigurtion() *Options {
 	return &Options{
-		MaxDatafileSize: MaxDatafileSize,
+		MaxDatafileSize:       MaxDatafileSize,
+		FragMergeTrigger:      FragMergeTrigger,
+		DeadBytesMergeTrigger: DeadBytesMergeTrigger,
+		MergeCheckInterval:    MergeCheckInterval,
+		VerifyChecksums:       true,
+		SyncPolicy:            SyncEveryInterval,
+		SyncInterval:          SyncInterval,
+		Index:                 HashIndex,
+		ExpirySweepInterval:   ExpirySweepInterval,
+		CompressionThreshold:  CompressionThreshold,
+		MaxKeySize:            MaxKeySize,
+		MaxValueSize:          MaxValueSize,
 	}
 }
 
@@ -48,6 +216,26 @@ type DB struct {
 	writeFileUpdateMutex *sync.Mutex
 
 	isMerging bool
+
+	// cache contains recently read values. It is nil if the cache is disabled.
+	cache *cache.LRU
+
+	// cipher encrypts the new datafiles and keyring contains the keys of all of the datafiles.
+	cipher  *encryption.Cipher
+	keyring encryption.Keyring
+
+	// pinned counts the snapshots that reference each datafile. Pinned datafiles are not merged,
+	// since the merge would move the entries the snapshots point to.
+	pinned      map[uint32]int
+	pinnedMutex sync.Mutex
+
+	// writes contains the write requests waiting for the writer goroutine.
+	writes chan *writeRequest
+
+	// closed is closed when the database is closed such that the background goroutines stop.
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
 }
 
 // GetDirectory returns the directory in which all the datafiles are begin stored.
@@ -66,103 +254,400 @@ func Open(directory string, options *Options) (*DB, error) {
 		options = DefaultConfigurtion()
 	}
 
+	if c := options.Compression; c != nil && (c.Codec() == compress.CodecNone || c.Codec() > compress.MaxCodec) {
+		return nil, ErrInvalidCodec
+	}
+
 	// we want to parse the datafiles before creating another writable one
 
 	db := &DB{
 		Options:   options,
-		KeyDir:    keydir.NewKeyDir(),
+		KeyDir:    newKeyDir(options.Index),
 		rwmutex:   &sync.RWMutex{},
 		directory: directory,
 		Manager:   make(map[uint32]*datafile.Datafile),
 		isMerging: false,
+		pinned:    make(map[uint32]int),
+		writes:    make(chan *writeRequest),
+		closed:    make(chan struct{}),
+	}
+
+	if options.ValueCacheBytes > 0 {
+		db.cache = cache.New(options.ValueCacheBytes)
+	}
+
+	if err := db.loadKeys(); err != nil {
+		return nil, err
 	}
 
 	if err := db.parsePersistanceFiles(); err != nil {
 		return nil, err
 	}
 
-	writableFile, err := datafile.NewDatafile(directory)
+	// the writable datafile gets an id that is larger than any of the existing ones.
+	var maxID uint32
+	for id := range db.Manager {
+		if id > maxID {
+			maxID = id
+		}
+	}
+
+	writableFile, err := db.openWritable(maxID + 1)
 	if err != nil {
 		return nil, err
 	}
 
 	db.WFile = writableFile
 
+	db.wg.Add(1)
+	go db.runWriter()
+
+	if options.MergeCheckInterval > 0 {
+		db.wg.Add(1)
+		go db.runMerger()
+	}
+
+	if options.SyncPolicy == SyncEveryInterval {
+		db.wg.Add(1)
+		go db.runSyncer()
+	}
+
+	if options.ExpirySweepInterval > 0 {
+		db.wg.Add(1)
+		go db.runSweeper()
+	}
+
 	return db, nil
 }
 
-// Put places a key-value pair into the database
-func (db *DB) Put(key, value []byte) error {
-	db.rwmutex.Lock()
-	defer db.rwmutex.Unlock()
-
-	// TODO: check the if the writable file is too large.
-	if db.WFile.Offset() > db.Options.MaxDatafileSize {
-		// close the file
-		db.WFile.Close()
+// newKeyDir creates a key directory with the given index type.
+func newKeyDir(index IndexType) *keydir.KeyDir {
+	switch index {
+	case OrderedIndex:
+		return keydir.NewOrderedKeyDir()
+	case CompactIndex:
+		return keydir.NewCompactKeyDir()
+	default:
+		return keydir.NewKeyDir()
+	}
+}
 
-		readable, err := datafile.NewReadOnlyDatafile(db.WFile.GetPath(db.directory))
-		if err != nil {
-			return fmt.Errorf("error opening readable file: %s", err)
+// loadKeys creates the ciphers for the encryption keys in the options.
+func (db *DB) loadKeys() error {
+	ciphers := make([]*encryption.Cipher, 0, len(db.Options.OldEncryptionKeys)+1)
+	for _, key := range append([][]byte{db.Options.EncryptionKey}, db.Options.OldEncryptionKeys...) {
+		if key == nil {
+			continue
 		}
 
-		db.Manager[db.WFile.ID()] = readable
-		writableFile, err := datafile.NewDatafile(db.directory)
+		c, err := encryption.New(key)
 		if err != nil {
-			return fmt.Errorf("error opening writable file: %s", err)
+			return err
 		}
-		db.WFile = writableFile
+		ciphers = append(ciphers, c)
 	}
 
-	entry, err := db.WFile.Write(key, value)
+	if db.Options.EncryptionKey != nil {
+		db.cipher = ciphers[0]
+	}
+
+	keyring, err := encryption.NewKeyring(ciphers...)
 	if err != nil {
 		return err
 	}
-
-	// write to the keydir
-	db.KeyDir.Put(string(key), entry)
+	db.keyring = keyring
 
 	return nil
 }
 
-// Delete removes a value from the database.
+// openWritable creates a new writable datafile with the given id. The datafile is encrypted if
+// EncryptionKey is set. The values are compressed before they are queued for the writer.
+func (db *DB) openWritable(id uint32) (*datafile.Datafile, error) {
+	df, err := datafile.NewDatafileWithID(db.directory, id, db.cipher)
+	if err != nil {
+		return nil, err
+	}
+	db.KeyDir.SetEntryOverhead(id, df.EntryOverhead())
+
+	return df, nil
+}
+
+// openReadOnly opens a read-only datafile and memory-maps it if MmapReads is set. If the mapping
+// fails, the datafile is read with pread instead.
+func (db *DB) openReadOnly(path string) (*datafile.Datafile, error) {
+	df, err := datafile.NewReadOnlyDatafile(path, db.keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	if db.Options.MmapReads {
+		if err := df.Mmap(); err != nil {
+			log.Printf("could not memory-map datafile %d: %s", df.ID(), err)
+		}
+	}
+	db.KeyDir.SetEntryOverhead(df.ID(), df.EntryOverhead())
+
+	return df, nil
+}
+
+// Put places a key-value pair into the database. Concurrent calls are committed together to
+// the datafile.
+func (db *DB) Put(key, value []byte) error {
+	return db.write([]*datafile.Entry{{
+		Timestamp: uint32(time.Now().Unix()),
+		Key:       key,
+		Value:     value,
+	}})
+}
+
+// Delete removes a value from the database. A tombstone entry is written to the datafile such that
+// the key stays deleted after the database is reopened.
 func (db *DB) Delete(key []byte) error {
-	return db.Put(key, []byte("\x00"))
+	if err := db.checkKey(key); err != nil {
+		return err
+	}
+
+	// the key doesn't exist so there is nothing to delete.
+	if db.KeyDir.Get(string(key)) == nil {
+		return nil
+	}
+
+	return db.write([]*datafile.Entry{{
+		Timestamp: uint32(time.Now().Unix()),
+		Key:       key,
+		Tombstone: true,
+	}})
 }
 
-// Close closes the database this is normally used when defering
-func (db *DB) Close() {
+// rotateWritableFile creates a new writable datafile if the current one has grown too large. The
+// caller needs to hold the write lock.
+func (db *DB) rotateWritableFile() error {
+	if db.WFile.Offset() <= db.Options.MaxDatafileSize {
+		return nil
+	}
+
+	// the datafile won't be written to anymore so make sure that it is on the disk before
+	// closing it.
+	if db.Options.SyncPolicy != SyncNever {
+		if err := db.WFile.Sync(); err != nil {
+			return err
+		}
+	}
+
+	// close the file
 	db.WFile.Close()
+
+	readable, err := db.openReadOnly(db.WFile.GetPath(db.directory))
+	if err != nil {
+		return fmt.Errorf("error opening readable file: %s", err)
+	}
+
+	db.Manager[db.WFile.ID()] = readable
+	writableFile, err := db.openWritable(db.WFile.ID() + 1)
+	if err != nil {
+		return fmt.Errorf("error opening writable file: %s", err)
+	}
+	db.WFile = writableFile
+
+	return nil
+}
+
+// Close closes the database this is normally used when defering. Calling close multiple times
+// is safe.
+func (db *DB) Close() {
+	db.closeOnce.Do(func() {
+		// stop the writer and the background compaction before closing the files they might be using.
+		close(db.closed)
+		db.wg.Wait()
+
+		db.rwmutex.Lock()
+		defer db.rwmutex.Unlock()
+
+		if db.Options.SyncPolicy != SyncNever {
+			if err := db.WFile.Sync(); err != nil {
+				log.Printf("could not sync the writable datafile: %s", err)
+			}
+		}
+
+		db.WFile.Close()
+		for _, df := range db.Manager {
+			df.Close()
+		}
+	})
 }
 
 // Get finds value with key and then returns the value.
 func (db *DB) Get(key []byte) ([]byte, error) {
+	value, _, err := db.get(key)
+	return value, err
+}
+
+// get reads the value of a key and also returns the key directory entry that points to it. The
+// entry of an expired key is returned together with ErrKeyNotFound.
+func (db *DB) get(key []byte) ([]byte, *keydir.MemEntry, error) {
 	db.rwmutex.RLock()
-	defer db.rwmutex.RLock()
+	defer db.rwmutex.RUnlock()
 
 	entry := db.KeyDir.Get(string(key))
 	if entry == nil {
-		return nil, errors.New("could not find value from keydir")
+		return nil, nil, ErrKeyNotFound
+	}
+
+	if entry.Expired(now()) {
+		return nil, entry, ErrKeyNotFound
+	}
+
+	location := cache.Key{FileID: entry.FileID, Offset: entry.ValOffset}
+	if db.cache != nil {
+		if value, ok := db.cache.Get(location); ok {
+			return value, entry, nil
+		}
+	}
+
+	value, err := db.readValue(key, entry)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if db.cache != nil {
+		db.cache.Add(location, value)
 	}
 
+	return value, entry, nil
+}
+
+// CacheStats returns the hit and miss counters of the value cache. All of the counters are zero if
+// the cache is disabled.
+func (db *DB) CacheStats() cache.Stats {
+	if db.cache == nil {
+		return cache.Stats{}
+	}
+
+	return db.cache.Stats()
+}
+
+// uncache removes the current value of a key from the value cache. The caller needs to hold the
+// write lock.
+func (db *DB) uncache(key string) {
+	if db.cache == nil {
+		return
+	}
+
+	if entry := db.KeyDir.Get(key); entry != nil {
+		db.cache.Remove(cache.Key{FileID: entry.FileID, Offset: entry.ValOffset})
+	}
+}
+
+// readValue reads the value a key directory entry points to. The caller needs to hold the read lock.
+func (db *DB) readValue(key []byte, entry *keydir.MemEntry) ([]byte, error) {
 	file, err := db.getDataFile(entry.FileID)
 	if err != nil {
 		return nil, errors.New("could not find key in the specified data file")
 	}
 
-	value, err := file.ReadOffset(entry.ValOffset, entry.ValSize)
+	var value []byte
+	if db.Options.VerifyChecksums {
+		value, err = file.ReadEntry(key, entry.ValOffset, entry.ValSize)
+	} else {
+		value, err = file.ReadValue(key, entry.ValOffset, entry.ValSize)
+	}
+
+	// an encrypted value that can't be authenticated has been modified.
+	if err == encoder.ErrChecksumMismatch || err == encryption.ErrDecrypt {
+		return nil, &CorruptedError{
+			FileID: entry.FileID,
+			Offset: file.EntryOffset(key, entry.ValOffset),
+		}
+	}
+
 	if err != nil {
 		return nil, errors.New("could not find key in the specified data file")
 	}
 
-	// check if the key has been deleted
-	if bytes.Equal(value, []byte("\x00")) {
-		return nil, errors.New("key was not found.")
+	return db.decompress(value, entry)
+}
+
+// decompress decompresses a value read from a datafile if it is compressed.
+func (db *DB) decompress(value []byte, entry *keydir.MemEntry) ([]byte, error) {
+	if entry.Codec == compress.CodecNone {
+		return value, nil
+	}
+
+	c, ok := compress.Lookup(entry.Codec)
+	if custom := db.Options.Compression; custom != nil && custom.Codec() == entry.Codec {
+		c, ok = custom, true
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownCodec, entry.Codec)
+	}
+
+	value, err := c.Decompress(value)
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress value: %w", err)
 	}
 
 	return value, nil
 }
 
+// View calls fn with the value of a key. When MmapReads is set the value is not copied from the
+// mapping unless it is compressed, so it is only valid until fn returns and it must not be
+// modified. The database lock isn't held while fn runs.
+func (db *DB) View(key []byte, fn func(value []byte) error) error {
+	value, release, err := db.view(key)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return fn(value)
+}
+
+// view returns the value of a key and a function that releases it.
+func (db *DB) view(key []byte) ([]byte, func(), error) {
+	db.rwmutex.RLock()
+	defer db.rwmutex.RUnlock()
+
+	entry := db.KeyDir.Get(string(key))
+	if entry == nil || entry.Expired(now()) {
+		return nil, nil, ErrKeyNotFound
+	}
+
+	file, err := db.getDataFile(entry.FileID)
+	if err != nil {
+		return nil, nil, errors.New("could not find key in the specified data file")
+	}
+
+	// compressed and encrypted values can't be viewed in place, so they are read into a new buffer.
+	if entry.Codec != compress.CodecNone || file.Encrypted() {
+		value, err := db.readValue(key, entry)
+		return value, func() {}, err
+	}
+
+	if !db.Options.VerifyChecksums {
+		value, release, err := file.View(entry.ValOffset, entry.ValSize)
+		if err != nil {
+			return nil, nil, errors.New("could not find key in the specified data file")
+		}
+
+		return value, release, nil
+	}
+
+	value, release, err := file.ViewEntry(key, entry.ValOffset, entry.ValSize)
+	if err == encoder.ErrChecksumMismatch {
+		return nil, nil, &CorruptedError{
+			FileID: entry.FileID,
+			Offset: file.EntryOffset(key, entry.ValOffset),
+		}
+	}
+
+	if err != nil {
+		return nil, nil, errors.New("could not find key in the specified data file")
+	}
+
+	return value, release, nil
+}
+
 func (db *DB) getDataFile(id uint32) (*datafile.Datafile, error) {
 	if db.WFile.ID() == id {
 		return db.WFile, nil
@@ -178,9 +663,11 @@ func (db *DB) getDataFile(id uint32) (*datafile.Datafile, error) {
 
 // parsePersistanceFiles takes in all of the hint files and then parses their metadata into
 // the keydirectory. The hint files are used to reduce startup time since without we would have
-// to scan files that are multiple gigabytes large.
+// to scan files that are multiple gigabytes large. If a hint file is missing or corrupt, the
+// datafile is scanned instead and a new hint file is written for it.
 func (db *DB) parsePersistanceFiles() error {
-	var hintfiles []string
+	hintfiles := make(map[uint32]bool)
+	var ids []uint32
 
 	files, err := ioutil.ReadDir(db.directory)
 	if err != nil {
@@ -188,69 +675,508 @@ func (db *DB) parsePersistanceFiles() error {
 	}
 
 	for _, file := range files {
+		// leftover files from a merge that didn't finish.
+		if strings.HasSuffix(file.Name(), ".tmp") {
+			if err := os.Remove(filepath.Join(db.directory, file.Name())); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !strings.HasSuffix(file.Name(), ".hnt") && !strings.HasSuffix(file.Name(), ".df") {
+			continue
+		}
+
+		fileID, err := datafile.ParseID(file.Name())
+		if err != nil {
+			log.Printf("could not parse file: %s", file.Name())
+			continue
+		}
+
 		if strings.HasSuffix(file.Name(), ".hnt") {
-			hintfiles = append(hintfiles, file.Name())
+			hintfiles[fileID] = true
+		} else {
+			ids = append(ids, fileID)
+		}
+	}
+
+	// the files need to be read from the oldest to the newest such that the newer entries
+	// overwrite the older ones in the key directory.
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	// only the newest datafile was being written to, so it is the only one that can contain
+	// a partial write.
+	if len(ids) > 0 {
+		newest := ids[len(ids)-1]
+		complete, err := db.recoverDatafile(newest, hintfiles[newest])
+		if err != nil {
+			return err
+		}
+
+		if !complete {
+			hintfiles[newest] = false
+		}
+	}
+
+	for _, fileID := range ids {
+		df, err := db.openReadOnly(datafile.Path(db.directory, fileID))
+		if err != nil {
+			return err
+		}
+		db.Manager[fileID] = df
+
+		if hintfiles[fileID] {
+			err := hint.AppendPathToKeyDir(hint.Path(db.directory, fileID), fileID, db.KeyDir, db.keyring)
+			if err == nil {
+				continue
+			}
+
+			// rebuilding the hint file wouldn't help, since the datafile has the same key.
+			if errors.Is(err, encryption.ErrUnknownKey) || errors.Is(err, encryption.ErrDecrypt) {
+				return fmt.Errorf("could not read hint file %d: %w", fileID, err)
+			}
+
+			log.Printf("could not parse hint file %d, rebuilding it from the datafile: %s", fileID, err)
+		} else {
+			log.Printf("hint file %d not found, rebuilding it from the datafile", fileID)
+		}
+
+		if err := datafile.RebuildKeyDir(df, db.directory, db.KeyDir); err != nil {
+			if errors.Is(err, encryption.ErrDecrypt) {
+				return fmt.Errorf("could not read datafile %d: %w", fileID, err)
+			}
+
+			log.Printf("could not read all entries from datafile %d: %s", fileID, err)
 		}
+	}
+
+	return nil
+}
+
+// recoverDatafile truncates partial entries from the end of a datafile and its hint file. It returns
+// false if the hint file doesn't cover all of the entries in the datafile, in which case the hint
+// file needs to be rebuilt.
+func (db *DB) recoverDatafile(id uint32, hasHint bool) (bool, error) {
+	dropped, size, err := datafile.Recover(datafile.Path(db.directory, id))
+	if err == datafile.ErrCorruptedEntry {
+		return false, &CorruptedError{FileID: id, Offset: size}
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	if dropped > 0 {
+		log.Printf("truncated %d bytes of partial writes from datafile %d", dropped, id)
+	}
+
+	if !hasHint {
+		return false, nil
+	}
+
+	dropped, end, err := hint.Recover(hint.Path(db.directory, id), size)
+	if err != nil {
+		return false, err
+	}
+
+	if dropped > 0 {
+		log.Printf("truncated %d bytes of partial writes from hint file %d", dropped, id)
+	}
+
+	return end == size, nil
+}
+
+// Sync flushes the writable datafile and its hint file to the disk.
+func (db *DB) Sync() error {
+	db.rwmutex.RLock()
+	defer db.rwmutex.RUnlock()
+
+	return db.WFile.Sync()
+}
+
+// runSyncer syncs the writable datafile every SyncInterval until the database is closed.
+func (db *DB) runSyncer() {
+	defer db.wg.Done()
+
+	// the writes would never be synced without an interval.
+	interval := db.Options.SyncInterval
+	if interval <= 0 {
+		interval = SyncInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.closed:
+			return
+		case <-ticker.C:
+			db.rwmutex.RLock()
+			err := db.WFile.SyncData()
+			db.rwmutex.RUnlock()
 
-		if strings.HasSuffix(file.Name(), ".df") {
-			df, err := datafile.NewReadOnlyDatafile(filepath.Join(
-				db.directory, file.Name(),
-			))
 			if err != nil {
-				return err
+				log.Printf("could not sync the writable datafile: %s", err)
 			}
+		}
+	}
+}
 
-			db.Manager[df.ID()] = df
+// runMerger periodically checks the datafiles and merges the ones that have crossed the
+// merge triggers. It runs until the database is closed.
+func (db *DB) runMerger() {
+	defer db.wg.Done()
+
+	ticker := time.NewTicker(db.Options.MergeCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.closed:
+			return
+		case <-ticker.C:
+			ids := db.getToBeMerged()
+			if len(ids) == 0 {
+				continue
+			}
+
+			if err := db.mergeFiles(ids); err != nil && err != ErrMergeInProgress {
+				log.Printf("background merge failed: %s", err)
+			}
 		}
 	}
+}
 
-	for _, hintfile := range hintfiles {
-		fileID, err := datafile.ParseID(hintfile)
-		if err != nil {
-			log.Printf("could not parse file: %d", fileID)
+// getToBeMerged returns the ids of the read-only datafiles that have crossed either the
+// fragmentation or the dead bytes trigger. The tombstones only count as dead bytes in the oldest
+// datafile, since a merge has to keep them if there is an older datafile.
+func (db *DB) getToBeMerged() []uint32 {
+	stats := db.FileStats()
+
+	db.rwmutex.RLock()
+	defer db.rwmutex.RUnlock()
+
+	oldest := db.WFile.ID()
+	for id := range db.Manager {
+		if id < oldest {
+			oldest = id
+		}
+	}
+
+	var ids []uint32
+	for id := range db.Manager {
+		fs := stats[id]
+		if id == oldest {
+			fs.DeadKeys += fs.Tombstones
+			fs.DeadBytes += fs.TombstoneBytes
+			fs.Tombstones, fs.TombstoneBytes = 0, 0
+		}
+
+		if fs.DeadKeys == 0 || db.isPinned(id) {
 			continue
 		}
 
-		if err := hint.AppendPathToKeyDir(
-			filepath.Join(db.directory, hintfile),
-			fileID,
-			db.KeyDir,
-		); err != nil {
-			log.Printf("could not parse file: %d", fileID)
+		if db.Options.DeadBytesMergeTrigger > 0 && fs.DeadBytes >= db.Options.DeadBytesMergeTrigger {
+			ids = append(ids, id)
 			continue
 		}
+
+		if db.Options.FragMergeTrigger > 0 && fs.Fragmentation() >= db.Options.FragMergeTrigger {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// FileStats returns the amount of live and dead keys and bytes in each of the datafiles.
+func (db *DB) FileStats() map[uint32]keydir.FileStats {
+	stats := db.KeyDir.Stats()
+
+	db.rwmutex.RLock()
+	defer db.rwmutex.RUnlock()
+
+	res := make(map[uint32]keydir.FileStats, len(db.Manager)+1)
+	for id := range db.Manager {
+		res[id] = stats[id]
+	}
+	res[db.WFile.ID()] = stats[db.WFile.ID()]
+
+	return res
+}
+
+// Merge compacts all of the read-only datafiles. Only the entries that the key directory still
+// points to are kept and the space taken by overwritten values is reclaimed. Datafiles referenced
+// by a snapshot are skipped.
+func (db *DB) Merge() error {
+	db.rwmutex.RLock()
+	ids := make([]uint32, 0, len(db.Manager))
+	for id := range db.Manager {
+		ids = append(ids, id)
+	}
+	db.rwmutex.RUnlock()
+
+	return db.mergeFiles(ids)
+}
+
+// mergeFiles merges the read-only datafiles with the given ids one by one.
+func (db *DB) mergeFiles(ids []uint32) error {
+	db.rwmutex.Lock()
+	if db.isMerging {
+		db.rwmutex.Unlock()
+		return ErrMergeInProgress
+	}
+	db.isMerging = true
+	db.rwmutex.Unlock()
+
+	defer func() {
+		db.rwmutex.Lock()
+		db.isMerging = false
+		db.rwmutex.Unlock()
+	}()
+
+	for _, id := range ids {
+		if err := db.mergeFile(id); err != nil {
+			return fmt.Errorf("could not merge datafile %d: %s", id, err)
+		}
 	}
 
 	return nil
 }
 
-func (db *DB) getToBeMerged() ([]string, error) {
-	files, err := ioutil.ReadDir(db.directory)
+// movedEntry holds the location of a key before and after it was copied by a merge.
+type movedEntry struct {
+	key       string
+	previous  *keydir.MemEntry
+	current   *keydir.MemEntry
+	tombstone bool
+}
+
+// mergeFile writes the live entries of a read-only datafile into a temporary datafile, which then
+// replaces the original datafile. The datafile keeps its id, so the ordering of the datafiles
+// doesn't change. The scanning is done without holding the database lock and the key directory
+// is only updated for keys that were not written to during the merge. Tombstones are kept if an
+// older datafile exists, since the older datafile might still contain the deleted value. For the
+// same reason expired entries are replaced with tombstones if there is an older datafile, and
+// otherwise they are dropped. Datafiles referenced by a snapshot are left as they are.
+func (db *DB) mergeFile(id uint32) error {
+	db.rwmutex.RLock()
+	df, ok := db.Manager[id]
+	writable := db.WFile.ID() == id
+	hasOlder := false
+	for other := range db.Manager {
+		if other < id {
+			hasOlder = true
+		}
+	}
+	db.rwmutex.RUnlock()
+	if !ok || writable {
+		return ErrNotReadOnly
+	}
+
+	if db.isPinned(id) {
+		return nil
+	}
+
+	merged, err := datafile.NewMergeDatafile(db.directory, id, db.cipher)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var res []string
-	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".hnt") && file.Size() < db.Options.MaxDatafileSize {
-			res = append(res, filepath.Join(db.directory, file.Name()))
+	// expired contains the keys whose live entry was dropped because it has expired.
+	var moved, expired []movedEntry
+	current := now()
+
+	scanner := datafile.InitDatafileScanner(df)
+	for {
+		entry, err := scanner.Scan()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			merged.Close()
+			removeMergeFiles(db.directory, id)
+			return err
+		}
+
+		if entry.Tombstone && !hasOlder {
+			continue
+		}
+
+		previous := db.KeyDir.Get(string(entry.Key))
+		live := previous != nil && previous.FileID == id && previous.ValOffset == entry.ValOffset
+
+		isExpired := !entry.Tombstone && entry.Expiry != 0 && current >= entry.Expiry
+		if isExpired {
+			if live {
+				expired = append(expired, movedEntry{key: string(entry.Key), previous: previous})
+			}
+
+			// the sweeper removes expired keys without writing a tombstone, so a tombstone is also
+			// needed if the key is no longer in the key directory.
+			if !hasOlder || (previous != nil && !live) {
+				continue
+			}
+
+			entry = &datafile.Entry{
+				Timestamp: entry.Timestamp,
+				Key:       entry.Key,
+				Tombstone: true,
+			}
+		}
+
+		if !entry.Tombstone && !live {
+			// the value has been overwritten so it can be dropped.
+			continue
+		}
+
+		mementry, err := merged.Append(entry)
+		if err != nil {
+			merged.Close()
+			removeMergeFiles(db.directory, id)
+			return err
 		}
+
+		moved = append(moved, movedEntry{
+			key:       string(entry.Key),
+			previous:  previous,
+			current:   mementry,
+			tombstone: entry.Tombstone,
+		})
 	}
+	// the merged files replace the original ones so they need to be on the disk first.
+	if err := merged.Sync(); err != nil {
+		merged.Close()
+		removeMergeFiles(db.directory, id)
+		return err
+	}
+	merged.Close()
 
-	return res, nil
-}
+	db.rwmutex.Lock()
+	defer db.rwmutex.Unlock()
+
+	// a snapshot was taken during the merge.
+	if db.isPinned(id) {
+		removeMergeFiles(db.directory, id)
+		return nil
+	}
+
+	// the datafile doesn't contain any live entries so it can be removed entirely.
+	if len(moved) == 0 {
+		removeMergeFiles(db.directory, id)
+		if err := replaceDatafile(db.directory, id, false); err != nil {
+			return err
+		}
+
+		df.Close()
+		delete(db.Manager, id)
+		db.KeyDir.DeleteStats(id)
+		db.removeExpiredEntries(expired)
+		if db.cache != nil {
+			db.cache.RemoveFile(id)
+		}
+
+		return nil
+	}
 
-func (db *DB) mergeFiles() error {
-	canBeMerged, err := db.getToBeMerged()
+	// the original datafile stays open until the merged one has been opened, so the key directory
+	// can still be read from if replacing the files fails.
+	if err := replaceDatafile(db.directory, id, true); err != nil {
+		removeMergeFiles(db.directory, id)
+		return err
+	}
+
+	readable, err := db.openReadOnly(datafile.Path(db.directory, id))
 	if err != nil {
 		return err
 	}
 
-	for _, file := range canBeMerged {
-		if _, err := utils.CopyFile(file, file+".tmp"); err != nil {
+	df.Close()
+	db.Manager[id] = readable
+	db.removeExpiredEntries(expired)
+
+	// the offsets in the rewritten datafile point to different values.
+	if db.cache != nil {
+		db.cache.RemoveFile(id)
+	}
+
+	var stats keydir.FileStats
+	for _, m := range moved {
+		size := readable.EntryOverhead() + int64(len(m.key)) + int64(m.current.ValSize)
+
+		if m.tombstone {
+			stats.Tombstones++
+			stats.TombstoneBytes += size
 			continue
 		}
+
+		// only update the entries that were not changed during the merge.
+		if db.KeyDir.Get(m.key).Equal(m.previous) {
+			db.KeyDir.Put(m.key, m.current)
+			stats.LiveKeys++
+			stats.LiveBytes += size
+		} else {
+			stats.DeadKeys++
+			stats.DeadBytes += size
+		}
 	}
 
+	// the old counters describe the file before it was rewritten.
+	db.KeyDir.SetStats(id, stats)
+
 	return nil
 }
+
+// removeExpiredEntries removes the expired keys dropped by a merge from the key directory. The keys
+// still point to the original datafile unless they were written to during the merge.
+func (db *DB) removeExpiredEntries(expired []movedEntry) {
+	for _, m := range expired {
+		if db.KeyDir.Get(m.key).Equal(m.previous) {
+			db.KeyDir.Delete(m.key)
+		}
+	}
+}
+
+// replaceDatafile replaces a datafile and its hint file with the files written by a merge, or
+// removes them if merged is false. The old hint file is removed first, so a crash can't leave
+// a hint file next to a datafile it doesn't describe. A datafile without a hint file is scanned
+// when the database is opened.
+func replaceDatafile(directory string, id uint32, merged bool) error {
+	if err := os.Remove(hint.Path(directory, id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := utils.SyncDirectory(directory); err != nil {
+		return err
+	}
+
+	if !merged {
+		return os.Remove(datafile.Path(directory, id))
+	}
+
+	if err := os.Rename(datafile.Path(directory, id)+".tmp", datafile.Path(directory, id)); err != nil {
+		return err
+	}
+
+	if err := os.Rename(hint.Path(directory, id)+".tmp", hint.Path(directory, id)); err != nil {
+		return err
+	}
+
+	return utils.SyncDirectory(directory)
+}
+
+// removeMergeFiles removes the temporary files created by a merge.
+func removeMergeFiles(directory string, id uint32) {
+	os.Remove(datafile.Path(directory, id) + ".tmp")
+	os.Remove(hint.Path(directory, id) + ".tmp")
+}
+
+// isPinned returns true if a snapshot references the datafile with the given id.
+func (db *DB) isPinned(id uint32) bool {
+	db.pinnedMutex.Lock()
+	defer db.pinnedMutex.Unlock()
+
+	return db.pinned[id] > 0
+}
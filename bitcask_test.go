@@ -1,20 +1,34 @@
 package bitcask_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/nireo/bitcask"
+	"github.com/nireo/bitcask/compress"
+	"github.com/nireo/bitcask/encoder"
+	"github.com/nireo/bitcask/encryption"
 )
 
 func createTestDatabase(t *testing.T) *bitcask.DB {
 	t.Helper()
-	db, err := bitcask.Open("./data", nil)
+	return createTestDatabaseWithOptions(t, nil)
+}
+
+func createTestDatabaseWithOptions(t *testing.T, options *bitcask.Options) *bitcask.DB {
+	t.Helper()
+	db, err := bitcask.Open("./data", options)
 	if err != nil {
 		t.Fatalf("could not create a database instance: %s", err)
 	}
@@ -182,3 +196,1543 @@ func TestDelete(t *testing.T) {
 		t.Errorf("found key after deletion")
 	}
 }
+
+func directorySize(t *testing.T, directory string) int64 {
+	t.Helper()
+
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		t.Fatalf("error reading files from directory: %s", err)
+	}
+
+	var size int64
+	for _, file := range files {
+		size += file.Size()
+	}
+
+	return size
+}
+
+func TestMerge(t *testing.T) {
+	db := createTestDatabaseWithOptions(t, &bitcask.Options{
+		MaxDatafileSize: 64 * 1024,
+	})
+
+	keys := []string{"key1", "key2", "key3", "key4", "key5"}
+	for i := 0; i < 100; i++ {
+		for _, key := range keys {
+			if err := db.Put([]byte(key), []byte("value"+strconv.Itoa(i))); err != nil {
+				t.Fatalf("error putting value into database: %s", err)
+			}
+		}
+	}
+
+	// fill the writable file such that the next write rotates it.
+	if err := db.Put([]byte("filler"), make([]byte, 64*1024)); err != nil {
+		t.Fatalf("error putting value into database: %s", err)
+	}
+	if err := db.Put([]byte("key6"), []byte("value")); err != nil {
+		t.Fatalf("error putting value into database: %s", err)
+	}
+
+	sizeBefore := directorySize(t, db.GetDirectory())
+	if err := db.Merge(); err != nil {
+		t.Fatalf("error merging datafiles: %s", err)
+	}
+
+	if sizeAfter := directorySize(t, db.GetDirectory()); sizeAfter >= sizeBefore {
+		t.Errorf("merge didn't reclaim space: before=%d after=%d", sizeBefore, sizeAfter)
+	}
+
+	for _, key := range keys {
+		value, err := db.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("could not get key %s after merge: %s", key, err)
+		}
+
+		if string(value) != "value99" {
+			t.Errorf("wrong value after merge. got=%s want=value99", string(value))
+		}
+	}
+
+	// the hint files written by the merge should point to the right values.
+	db.Close()
+	db, err := bitcask.Open("./data", nil)
+	if err != nil {
+		t.Fatalf("could not open the database: %s", err)
+	}
+	defer db.Close()
+
+	for _, key := range keys {
+		value, err := db.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("could not get key %s after reopening: %s", key, err)
+		}
+
+		if string(value) != "value99" {
+			t.Errorf("wrong value after reopening. got=%s want=value99", string(value))
+		}
+	}
+}
+
+func TestBackgroundMerge(t *testing.T) {
+	db := createTestDatabaseWithOptions(t, &bitcask.Options{
+		MaxDatafileSize:    64 * 1024,
+		FragMergeTrigger:   50,
+		MergeCheckInterval: 50 * time.Millisecond,
+	})
+
+	for i := 0; i < 100; i++ {
+		if err := db.Put([]byte("key"), []byte("value"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("error putting value into database: %s", err)
+		}
+	}
+
+	if err := db.Put([]byte("filler"), make([]byte, 64*1024)); err != nil {
+		t.Fatalf("error putting value into database: %s", err)
+	}
+
+	// the filler is overwritten such that the first datafile is mostly dead bytes.
+	sizeBefore := directorySize(t, db.GetDirectory())
+	if err := db.Put([]byte("filler"), []byte("value")); err != nil {
+		t.Fatalf("error putting value into database: %s", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	if sizeAfter := directorySize(t, db.GetDirectory()); sizeAfter >= sizeBefore {
+		t.Errorf("background merge didn't reclaim space: before=%d after=%d", sizeBefore, sizeAfter)
+	}
+
+	value, err := db.Get([]byte("key"))
+	if err != nil {
+		t.Fatalf("could not get key after merge: %s", err)
+	}
+
+	if string(value) != "value99" {
+		t.Errorf("wrong value after merge. got=%s want=value99", string(value))
+	}
+}
+
+func TestMergeKeepsTombstones(t *testing.T) {
+	db := createTestDatabaseWithOptions(t, &bitcask.Options{
+		MaxDatafileSize:    1024,
+		FragMergeTrigger:   50,
+		MergeCheckInterval: 20 * time.Millisecond,
+	})
+
+	// the oldest datafile stays live, so the tombstones in the newer datafiles need to be kept.
+	for i := 0; i < 30; i++ {
+		if err := db.Put([]byte("live"+strconv.Itoa(i)), []byte("value")); err != nil {
+			t.Fatalf("error putting value into database: %s", err)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		if err := db.Put([]byte("deleted"+strconv.Itoa(i)), []byte("value")); err != nil {
+			t.Fatalf("error putting value into database: %s", err)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		if err := db.Delete([]byte("deleted" + strconv.Itoa(i))); err != nil {
+			t.Fatalf("error deleting key: %s", err)
+		}
+	}
+
+	// rotate the datafile such that all of the tombstones are in read-only datafiles.
+	if err := db.Put([]byte("filler"), make([]byte, 1024)); err != nil {
+		t.Fatalf("error putting value into database: %s", err)
+	}
+	if err := db.Put([]byte("last"), []byte("value")); err != nil {
+		t.Fatalf("error putting value into database: %s", err)
+	}
+
+	// a full merge rewrites the datafiles that only contain tombstones.
+	for {
+		err := db.Merge()
+		if err == nil {
+			break
+		}
+
+		if err != bitcask.ErrMergeInProgress {
+			t.Fatalf("error merging datafiles: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	var tombstones int64
+	for _, stats := range db.FileStats() {
+		tombstones += stats.Tombstones
+	}
+
+	if tombstones == 0 {
+		t.Fatalf("the merges didn't keep any tombstones")
+	}
+
+	files, err := filepath.Glob("./data/*.df")
+	if err != nil {
+		t.Fatalf("could not list datafiles: %s", err)
+	}
+
+	before := make(map[string]os.FileInfo)
+	for _, file := range files {
+		if before[file], err = os.Stat(file); err != nil {
+			t.Fatalf("could not stat datafile: %s", err)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	// the following merge passes have nothing to reclaim.
+	for file, info := range before {
+		after, err := os.Stat(file)
+		if err != nil {
+			t.Fatalf("datafile %s was removed: %s", file, err)
+		}
+
+		if !os.SameFile(info, after) {
+			t.Errorf("datafile %s was rewritten by another merge", file)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		if _, err := db.Get([]byte("deleted" + strconv.Itoa(i))); err != bitcask.ErrKeyNotFound {
+			t.Errorf("a deleted key was found. err=%v", err)
+		}
+	}
+}
+
+func TestFileStats(t *testing.T) {
+	db := createTestDatabase(t)
+
+	for i := 0; i < 10; i++ {
+		if err := db.Put([]byte("key"), []byte("value")); err != nil {
+			t.Fatalf("error putting value into database: %s", err)
+		}
+	}
+
+	var live, dead int64
+	for _, stats := range db.FileStats() {
+		live += stats.LiveKeys
+		dead += stats.DeadKeys
+	}
+
+	if live != 1 {
+		t.Errorf("wrong amount of live keys. got=%d want=1", live)
+	}
+
+	if dead != 9 {
+		t.Errorf("wrong amount of dead keys. got=%d want=9", dead)
+	}
+}
+
+func TestFileStatsBytes(t *testing.T) {
+	options := &bitcask.Options{
+		MaxDatafileSize: 1024,
+		EncryptionKey:   bytes.Repeat([]byte{1}, 16),
+	}
+	db := createTestDatabaseWithOptions(t, options)
+
+	for i := 0; i < 100; i++ {
+		if err := db.Put([]byte("key"+strconv.Itoa(i%30)), []byte("value"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("error putting value into database: %s", err)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := db.Delete([]byte("key" + strconv.Itoa(i))); err != nil {
+			t.Fatalf("error deleting key: %s", err)
+		}
+	}
+
+	// the counters match the datafiles both when they are counted from the writes and from the
+	// hint files.
+	for reopen := 0; reopen < 2; reopen++ {
+		for id, stats := range db.FileStats() {
+			info, err := os.Stat(filepath.Join("./data", strconv.Itoa(int(id))+".df"))
+			if err != nil {
+				t.Fatalf("could not stat datafile: %s", err)
+			}
+
+			if got := stats.LiveBytes + stats.DeadBytes + stats.TombstoneBytes; got != info.Size()-encoder.FileHeaderSize {
+				t.Errorf("wrong amount of bytes in datafile %d. got=%d want=%d", id, got, info.Size()-encoder.FileHeaderSize)
+			}
+		}
+
+		db.Close()
+		var err error
+		if db, err = bitcask.Open("./data", options); err != nil {
+			t.Fatalf("could not open the database: %s", err)
+		}
+		defer db.Close()
+	}
+}
+
+func TestRebuildWithoutHintFiles(t *testing.T) {
+	db := createTestDatabase(t)
+
+	for i := 0; i < 100; i++ {
+		if err := db.Put([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("error putting value into database: %s", err)
+		}
+	}
+	db.Close()
+
+	files, err := ioutil.ReadDir(db.GetDirectory())
+	if err != nil {
+		t.Fatalf("error reading files from directory: %s", err)
+	}
+
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".hnt") {
+			if err := os.Remove(filepath.Join(db.GetDirectory(), file.Name())); err != nil {
+				t.Fatalf("could not remove hint file: %s", err)
+			}
+		}
+	}
+
+	db, err = bitcask.Open("./data", nil)
+	if err != nil {
+		t.Fatalf("could not open the database: %s", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		value, err := db.Get([]byte("key" + strconv.Itoa(i)))
+		if err != nil {
+			t.Fatalf("could not get key after rebuilding: %s", err)
+		}
+
+		if string(value) != "value"+strconv.Itoa(i) {
+			t.Errorf("wrong value after rebuilding. got=%s want=%s", string(value), "value"+strconv.Itoa(i))
+		}
+	}
+}
+
+func TestTornWriteRecovery(t *testing.T) {
+	db := createTestDatabase(t)
+
+	for i := 0; i < 10; i++ {
+		if err := db.Put([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("error putting value into database: %s", err)
+		}
+	}
+	path := db.WFile.GetPath(db.GetDirectory())
+	db.Close()
+
+	// append half of an entry to the datafile to simulate a crash in the middle of a write.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0777)
+	if err != nil {
+		t.Fatalf("could not open datafile: %s", err)
+	}
+
+	if _, err := f.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}); err != nil {
+		t.Fatalf("could not write to datafile: %s", err)
+	}
+	f.Close()
+
+	db, err = bitcask.Open("./data", nil)
+	if err != nil {
+		t.Fatalf("could not open the database: %s", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		value, err := db.Get([]byte("key" + strconv.Itoa(i)))
+		if err != nil {
+			t.Fatalf("could not get key after recovery: %s", err)
+		}
+
+		if string(value) != "value"+strconv.Itoa(i) {
+			t.Errorf("wrong value after recovery. got=%s want=%s", string(value), "value"+strconv.Itoa(i))
+		}
+	}
+}
+
+func TestCorruptEntryOnOpen(t *testing.T) {
+	db := createTestDatabase(t)
+
+	for i := 0; i < 100; i++ {
+		if err := db.Put([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("error putting value into database: %s", err)
+		}
+	}
+	path := db.WFile.GetPath(db.GetDirectory())
+	db.Close()
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("could not stat datafile: %s", err)
+	}
+
+	// flip a byte in one of the first entries.
+	f, err := os.OpenFile(path, os.O_RDWR, 0777)
+	if err != nil {
+		t.Fatalf("could not open datafile: %s", err)
+	}
+
+	b := make([]byte, 1)
+	f.ReadAt(b, 60)
+	if _, err := f.WriteAt([]byte{b[0] ^ 0xff}, 60); err != nil {
+		t.Fatalf("could not write to datafile: %s", err)
+	}
+	f.Close()
+
+	if db, err := bitcask.Open("./data", nil); !errors.Is(err, bitcask.ErrCorrupted) {
+		if err == nil {
+			db.Close()
+		}
+		t.Fatalf("expected a corruption error. got=%v", err)
+	}
+
+	if after, _ := os.Stat(path); after.Size() != stat.Size() {
+		t.Errorf("the datafile was truncated. got=%d want=%d", after.Size(), stat.Size())
+	}
+}
+
+func TestGetCorrupted(t *testing.T) {
+	db := createTestDatabase(t)
+
+	if err := db.Put([]byte("hello"), []byte("world")); err != nil {
+		t.Fatalf("error putting value into database: %s", err)
+	}
+
+	// flip a byte in the value without updating the checksum.
+	f, err := os.OpenFile(db.WFile.GetPath(db.GetDirectory()), os.O_WRONLY, 0777)
+	if err != nil {
+		t.Fatalf("could not open datafile: %s", err)
+	}
+
+	if _, err := f.WriteAt([]byte("W"), db.KeyDir.Get("hello").ValOffset); err != nil {
+		t.Fatalf("could not write to datafile: %s", err)
+	}
+	f.Close()
+
+	_, err = db.Get([]byte("hello"))
+	if !errors.Is(err, bitcask.ErrCorrupted) {
+		t.Fatalf("expected a corruption error. got=%v", err)
+	}
+
+	var corrupted *bitcask.CorruptedError
+	if !errors.As(err, &corrupted) {
+		t.Fatalf("the error is not a CorruptedError")
+	}
+
+	// the entry is the first one after the file header.
+	if corrupted.FileID != db.WFile.ID() || corrupted.Offset != encoder.FileHeaderSize {
+		t.Errorf("wrong location in the error. got=%d:%d want=%d:%d",
+			corrupted.FileID, corrupted.Offset, db.WFile.ID(), encoder.FileHeaderSize)
+	}
+}
+
+func TestDeletePersistance(t *testing.T) {
+	db := createTestDatabase(t)
+
+	if err := db.Put([]byte("hello"), []byte("world")); err != nil {
+		t.Fatalf("error putting value into database: %s", err)
+	}
+
+	// a single zero byte used to be the deletion marker.
+	if err := db.Put([]byte("zero"), []byte("\x00")); err != nil {
+		t.Fatalf("error putting value into database: %s", err)
+	}
+
+	if err := db.Delete([]byte("hello")); err != nil {
+		t.Fatalf("error deleting key: %s", err)
+	}
+	db.Close()
+
+	db, err := bitcask.Open("./data", nil)
+	if err != nil {
+		t.Fatalf("could not open the database: %s", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Get([]byte("hello")); err == nil {
+		t.Errorf("found key after deletion")
+	}
+
+	if db.KeyDir.Get("hello") != nil {
+		t.Errorf("the deleted key is still in the key directory")
+	}
+
+	value, err := db.Get([]byte("zero"))
+	if err != nil {
+		t.Fatalf("could not get key: %s", err)
+	}
+
+	if string(value) != "\x00" {
+		t.Errorf("wrong value. got=%v want=%v", value, []byte("\x00"))
+	}
+}
+
+func TestOpenInvalidDatafile(t *testing.T) {
+	if err := os.MkdirAll("./data", 0777); err != nil {
+		t.Fatalf("could not create directory: %s", err)
+	}
+	defer os.RemoveAll("./data")
+
+	if err := ioutil.WriteFile("./data/1.df", []byte("this is not a datafile"), 0777); err != nil {
+		t.Fatalf("could not write file: %s", err)
+	}
+
+	if _, err := bitcask.Open("./data", nil); !errors.Is(err, encoder.ErrInvalidMagic) {
+		t.Errorf("expected an invalid magic error. got=%v", err)
+	}
+}
+
+func TestDatafileIDs(t *testing.T) {
+	db := createTestDatabaseWithOptions(t, &bitcask.Options{
+		MaxDatafileSize: 1024,
+	})
+
+	// rotate the datafile many times in the same second.
+	for i := 0; i < 1000; i++ {
+		if err := db.Put([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("error putting value into database: %s", err)
+		}
+	}
+	firstID := db.WFile.ID()
+	db.Close()
+
+	db, err := bitcask.Open("./data", &bitcask.Options{
+		MaxDatafileSize: 1024,
+	})
+	if err != nil {
+		t.Fatalf("could not open the database: %s", err)
+	}
+	defer db.Close()
+
+	if db.WFile.ID() <= firstID {
+		t.Errorf("the new writable file didn't get a larger id. got=%d previous=%d", db.WFile.ID(), firstID)
+	}
+
+	if err := db.Put([]byte("key0"), []byte("new")); err != nil {
+		t.Fatalf("error putting value into database: %s", err)
+	}
+
+	for i := 1; i < 1000; i++ {
+		value, err := db.Get([]byte("key" + strconv.Itoa(i)))
+		if err != nil {
+			t.Fatalf("could not get key: %s", err)
+		}
+
+		if string(value) != "value"+strconv.Itoa(i) {
+			t.Errorf("wrong value. got=%s want=%s", string(value), "value"+strconv.Itoa(i))
+		}
+	}
+}
+
+func TestSyncPolicies(t *testing.T) {
+	policies := []bitcask.SyncPolicy{bitcask.SyncNever, bitcask.SyncAlways, bitcask.SyncEveryInterval}
+
+	for _, policy := range policies {
+		db := createTestDatabaseWithOptions(t, &bitcask.Options{
+			MaxDatafileSize: 1024,
+			SyncPolicy:      policy,
+			SyncInterval:    10 * time.Millisecond,
+		})
+
+		for i := 0; i < 100; i++ {
+			if err := db.Put([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))); err != nil {
+				t.Fatalf("error putting value into database: %s", err)
+			}
+		}
+
+		if err := db.Delete([]byte("key0")); err != nil {
+			t.Fatalf("error deleting key: %s", err)
+		}
+
+		if err := db.Sync(); err != nil {
+			t.Errorf("could not sync the database: %s", err)
+		}
+
+		// let the background syncing run a few times.
+		time.Sleep(50 * time.Millisecond)
+
+		for i := 1; i < 100; i++ {
+			if _, err := db.Get([]byte("key" + strconv.Itoa(i))); err != nil {
+				t.Errorf("could not get key: %s", err)
+			}
+		}
+
+		db.Close()
+		if err := os.RemoveAll(db.GetDirectory()); err != nil {
+			t.Fatalf("could not remove the database directory: %s", err)
+		}
+	}
+}
+
+func TestConcurrentPut(t *testing.T) {
+	db := createTestDatabaseWithOptions(t, &bitcask.Options{
+		MaxDatafileSize: 64 * 1024,
+		SyncPolicy:      bitcask.SyncAlways,
+	})
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 16; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+
+			for i := 0; i < 100; i++ {
+				key := strconv.Itoa(worker) + "-" + strconv.Itoa(i)
+				if err := db.Put([]byte(key), []byte("value"+key)); err != nil {
+					t.Errorf("error putting value into database: %s", err)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	for worker := 0; worker < 16; worker++ {
+		for i := 0; i < 100; i++ {
+			key := strconv.Itoa(worker) + "-" + strconv.Itoa(i)
+			value, err := db.Get([]byte(key))
+			if err != nil {
+				t.Fatalf("could not get key %s: %s", key, err)
+			}
+
+			if string(value) != "value"+key {
+				t.Errorf("wrong value. got=%s want=%s", string(value), "value"+key)
+			}
+		}
+	}
+}
+
+func TestPutAfterClose(t *testing.T) {
+	db := createTestDatabase(t)
+	db.Close()
+
+	if err := db.Put([]byte("hello"), []byte("world")); err != bitcask.ErrClosed {
+		t.Errorf("expected ErrClosed. got=%v", err)
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	db := createTestDatabase(t)
+
+	if err := db.Put([]byte("deleted"), []byte("value")); err != nil {
+		t.Fatalf("error putting value into database: %s", err)
+	}
+
+	batch := bitcask.NewBatch()
+	for i := 0; i < 10; i++ {
+		batch.Put([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i)))
+	}
+	batch.Delete([]byte("deleted"))
+
+	if err := db.Write(batch); err != nil {
+		t.Fatalf("could not write batch: %s", err)
+	}
+	db.Close()
+
+	db, err := bitcask.Open("./data", nil)
+	if err != nil {
+		t.Fatalf("could not open the database: %s", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		value, err := db.Get([]byte("key" + strconv.Itoa(i)))
+		if err != nil {
+			t.Fatalf("could not get key written in a batch: %s", err)
+		}
+
+		if string(value) != "value"+strconv.Itoa(i) {
+			t.Errorf("wrong value. got=%s want=%s", string(value), "value"+strconv.Itoa(i))
+		}
+	}
+
+	if _, err := db.Get([]byte("deleted")); err == nil {
+		t.Errorf("key deleted in a batch was found")
+	}
+}
+
+func TestUncommittedBatch(t *testing.T) {
+	for _, removeHint := range []bool{false, true} {
+		db := createTestDatabase(t)
+
+		if err := db.Put([]byte("existing"), []byte("value")); err != nil {
+			t.Fatalf("error putting value into database: %s", err)
+		}
+
+		batch := bitcask.NewBatch()
+		batch.Put([]byte("hello"), []byte("world"))
+		batch.Put([]byte("existing"), []byte("changed"))
+		if err := db.Write(batch); err != nil {
+			t.Fatalf("could not write batch: %s", err)
+		}
+		path := db.WFile.GetPath(db.GetDirectory())
+		id := db.WFile.ID()
+		db.Close()
+
+		// remove the commit entry to simulate a crash before it was written.
+		stat, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("could not stat datafile: %s", err)
+		}
+
+		if err := os.Truncate(path, stat.Size()-encoder.EntryHeaderSize-4); err != nil {
+			t.Fatalf("could not truncate datafile: %s", err)
+		}
+
+		if removeHint {
+			os.Remove(filepath.Join("./data", strconv.Itoa(int(id))+".hnt"))
+		}
+
+		db, err = bitcask.Open("./data", nil)
+		if err != nil {
+			t.Fatalf("could not open the database: %s", err)
+		}
+
+		if _, err := db.Get([]byte("hello")); err == nil {
+			t.Errorf("found a key from an uncommitted batch")
+		}
+
+		value, err := db.Get([]byte("existing"))
+		if err != nil || string(value) != "value" {
+			t.Errorf("wrong value after uncommitted batch. got=%s err=%v", string(value), err)
+		}
+		db.Close()
+		os.RemoveAll("./data")
+	}
+}
+
+func TestTxnConflict(t *testing.T) {
+	db := createTestDatabase(t)
+
+	if err := db.Put([]byte("counter"), []byte("0")); err != nil {
+		t.Fatalf("error putting value into database: %s", err)
+	}
+
+	txn := db.Begin()
+	if _, err := txn.Get([]byte("counter")); err != nil {
+		t.Fatalf("could not get key in transaction: %s", err)
+	}
+
+	if err := txn.Put([]byte("counter"), []byte("1")); err != nil {
+		t.Fatalf("could not put key in transaction: %s", err)
+	}
+
+	// the transaction sees its own writes, but others don't before the commit.
+	if value, _ := txn.Get([]byte("counter")); string(value) != "1" {
+		t.Errorf("transaction didn't see its own write. got=%s", string(value))
+	}
+
+	if value, _ := db.Get([]byte("counter")); string(value) != "0" {
+		t.Errorf("uncommitted write was visible. got=%s", string(value))
+	}
+
+	if err := db.Put([]byte("counter"), []byte("5")); err != nil {
+		t.Fatalf("error putting value into database: %s", err)
+	}
+
+	if err := txn.Commit(); err != bitcask.ErrConflict {
+		t.Fatalf("expected a conflict. got=%v", err)
+	}
+
+	if value, _ := db.Get([]byte("counter")); string(value) != "5" {
+		t.Errorf("conflicting transaction was written. got=%s", string(value))
+	}
+
+	if err := txn.Commit(); err != bitcask.ErrTxnDone {
+		t.Errorf("expected ErrTxnDone. got=%v", err)
+	}
+
+	// a key that didn't exist conflicts if it is created.
+	txn = db.Begin()
+	if _, err := txn.Get([]byte("missing")); err != bitcask.ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound. got=%v", err)
+	}
+	txn.Put([]byte("other"), []byte("value"))
+
+	if err := db.Put([]byte("missing"), []byte("value")); err != nil {
+		t.Fatalf("error putting value into database: %s", err)
+	}
+
+	if err := txn.Commit(); err != bitcask.ErrConflict {
+		t.Errorf("expected a conflict. got=%v", err)
+	}
+}
+
+func TestTxnCounter(t *testing.T) {
+	db := createTestDatabase(t)
+
+	if err := db.Put([]byte("counter"), []byte("0")); err != nil {
+		t.Fatalf("error putting value into database: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 50; i++ {
+				for {
+					txn := db.Begin()
+					value, err := txn.Get([]byte("counter"))
+					if err != nil {
+						t.Errorf("could not get counter: %s", err)
+						return
+					}
+
+					n, _ := strconv.Atoi(string(value))
+					txn.Put([]byte("counter"), []byte(strconv.Itoa(n+1)))
+
+					err = txn.Commit()
+					if err == bitcask.ErrConflict {
+						continue
+					}
+
+					if err != nil {
+						t.Errorf("could not commit transaction: %s", err)
+						return
+					}
+					break
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := db.Get([]byte("counter"))
+	if err != nil {
+		t.Fatalf("could not get counter: %s", err)
+	}
+
+	if string(value) != "400" {
+		t.Errorf("wrong counter value. got=%s want=400", string(value))
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	db := createTestDatabaseWithOptions(t, &bitcask.Options{
+		MaxDatafileSize: 1024,
+		VerifyChecksums: true,
+	})
+
+	for i := 0; i < 50; i++ {
+		if err := db.Put([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("error putting value into database: %s", err)
+		}
+	}
+
+	snapshot := db.Snapshot()
+	defer snapshot.Release()
+
+	// overwrite and delete keys such that the datafiles are rotated and the old values are dead.
+	for i := 0; i < 50; i++ {
+		if i%2 == 0 {
+			if err := db.Delete([]byte("key" + strconv.Itoa(i))); err != nil {
+				t.Fatalf("could not delete key: %s", err)
+			}
+			continue
+		}
+
+		if err := db.Put([]byte("key"+strconv.Itoa(i)), []byte("changed")); err != nil {
+			t.Fatalf("error putting value into database: %s", err)
+		}
+	}
+
+	if err := db.Put([]byte("new"), []byte("value")); err != nil {
+		t.Fatalf("error putting value into database: %s", err)
+	}
+
+	if err := db.Merge(); err != nil {
+		t.Fatalf("could not merge the database: %s", err)
+	}
+
+	for i := 0; i < 50; i++ {
+		value, err := snapshot.Get([]byte("key" + strconv.Itoa(i)))
+		if err != nil {
+			t.Fatalf("could not get key from snapshot: %s", err)
+		}
+
+		if string(value) != "value"+strconv.Itoa(i) {
+			t.Errorf("snapshot saw a later write. got=%s want=%s", string(value), "value"+strconv.Itoa(i))
+		}
+	}
+
+	if _, err := snapshot.Get([]byte("new")); err != bitcask.ErrKeyNotFound {
+		t.Errorf("snapshot saw a key added later. got=%v", err)
+	}
+
+	count := 0
+	if err := snapshot.Fold(func(key, value []byte) error {
+		count++
+		return nil
+	}); err != nil {
+		t.Fatalf("could not iterate the snapshot: %s", err)
+	}
+
+	if count != 50 {
+		t.Errorf("wrong amount of keys in the snapshot. got=%d want=50", count)
+	}
+
+	// the files can be merged after the snapshot is released.
+	before := directorySize(t, db.GetDirectory())
+	snapshot.Release()
+	if err := db.Merge(); err != nil {
+		t.Fatalf("could not merge the database: %s", err)
+	}
+
+	if after := directorySize(t, db.GetDirectory()); after >= before {
+		t.Errorf("merge didn't reclaim space after release. before=%d after=%d", before, after)
+	}
+
+	if _, err := snapshot.Get([]byte("key1")); err != bitcask.ErrSnapshotReleased {
+		t.Errorf("expected ErrSnapshotReleased. got=%v", err)
+	}
+}
+
+func TestFold(t *testing.T) {
+	db := createTestDatabase(t)
+
+	for i := 0; i < 20; i++ {
+		if err := db.Put([]byte("user:"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("error putting value into database: %s", err)
+		}
+
+		if err := db.Put([]byte("item:"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("error putting value into database: %s", err)
+		}
+	}
+
+	if err := db.Delete([]byte("user:0")); err != nil {
+		t.Fatalf("could not delete key: %s", err)
+	}
+
+	keys := 0
+	if err := db.Keys(func(key []byte) error {
+		keys++
+		return nil
+	}); err != nil {
+		t.Fatalf("could not iterate keys: %s", err)
+	}
+
+	if keys != 39 {
+		t.Errorf("wrong amount of keys. got=%d want=39", keys)
+	}
+
+	// writes during the iteration are allowed and deleted keys are skipped.
+	pairs := 0
+	if err := db.Fold(func(key, value []byte) error {
+		pairs++
+		if string(key) == "item:5" {
+			return db.Delete([]byte("item:6"))
+		}
+
+		if string(key) == "item:6" {
+			return db.Delete([]byte("item:5"))
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("could not fold the database: %s", err)
+	}
+
+	if pairs != 38 {
+		t.Errorf("wrong amount of pairs. got=%d want=38", pairs)
+	}
+
+	found := map[string]string{}
+	if err := db.Scan([]byte("user:"), func(key, value []byte) error {
+		found[string(key)] = string(value)
+		return nil
+	}); err != nil {
+		t.Fatalf("could not scan the database: %s", err)
+	}
+
+	if len(found) != 19 {
+		t.Errorf("wrong amount of keys with prefix. got=%d want=19", len(found))
+	}
+
+	for key, value := range found {
+		if !strings.HasPrefix(key, "user:") || value != "value"+strings.TrimPrefix(key, "user:") {
+			t.Errorf("wrong pair from scan. key=%s value=%s", key, value)
+		}
+	}
+
+	// returning an error stops the iteration.
+	stop := errors.New("stop")
+	calls := 0
+	if err := db.Scan([]byte("user:"), func(key, value []byte) error {
+		calls++
+		return stop
+	}); err != stop {
+		t.Errorf("expected the error from the callback. got=%v", err)
+	}
+
+	if calls != 1 {
+		t.Errorf("the iteration didn't stop. calls=%d", calls)
+	}
+}
+
+func TestRange(t *testing.T) {
+	for _, index := range []bitcask.IndexType{bitcask.HashIndex, bitcask.OrderedIndex, bitcask.CompactIndex} {
+		options := bitcask.DefaultConfigurtion()
+		options.Index = index
+		db := createTestDatabaseWithOptions(t, options)
+
+		for i := 0; i < 10; i++ {
+			if err := db.Put([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))); err != nil {
+				t.Fatalf("error putting value into database: %s", err)
+			}
+		}
+
+		if err := db.Put([]byte("other"), []byte("value")); err != nil {
+			t.Fatalf("error putting value into database: %s", err)
+		}
+
+		collect := func(iterate func(fn func(key, value []byte) error) error) string {
+			var keys []string
+			if err := iterate(func(key, value []byte) error {
+				if string(value) != "value"+strings.TrimPrefix(string(key), "key") && string(key) != "other" {
+					t.Errorf("wrong value for key %s: %s", key, value)
+				}
+				keys = append(keys, string(key))
+				return nil
+			}); err != nil {
+				t.Fatalf("could not iterate the database: %s", err)
+			}
+
+			return strings.Join(keys, ",")
+		}
+
+		got := collect(func(fn func(key, value []byte) error) error {
+			return db.Range([]byte("key3"), []byte("key6"), fn)
+		})
+		if got != "key3,key4,key5" {
+			t.Errorf("wrong range. got=%s", got)
+		}
+
+		got = collect(func(fn func(key, value []byte) error) error {
+			return db.RangeReverse([]byte("key7"), nil, fn)
+		})
+		if got != "other,key9,key8,key7" {
+			t.Errorf("wrong reverse range. got=%s", got)
+		}
+
+		got = collect(func(fn func(key, value []byte) error) error {
+			return db.Prefix([]byte("key"), fn)
+		})
+		if got != "key0,key1,key2,key3,key4,key5,key6,key7,key8,key9" {
+			t.Errorf("wrong prefix iteration. got=%s", got)
+		}
+
+		key, err := db.Seek([]byte("key99"))
+		if err != nil || string(key) != "other" {
+			t.Errorf("wrong seek result. got=%s err=%v", key, err)
+		}
+
+		db.Close()
+		os.RemoveAll(db.GetDirectory())
+	}
+}
+
+func TestParallelReads(t *testing.T) {
+	for _, verify := range []bool{false, true} {
+		db := createTestDatabaseWithOptions(t, &bitcask.Options{
+			MaxDatafileSize: 16 * 1024,
+			VerifyChecksums: verify,
+		})
+
+		for i := 0; i < 1000; i++ {
+			if err := db.Put([]byte("key"+strconv.Itoa(i)), []byte(strings.Repeat(strconv.Itoa(i), 10))); err != nil {
+				t.Fatalf("error putting value into database: %s", err)
+			}
+		}
+
+		var wg sync.WaitGroup
+		for worker := 0; worker < 16; worker++ {
+			wg.Add(1)
+			go func(worker int) {
+				defer wg.Done()
+
+				r := rand.New(rand.NewSource(int64(worker)))
+				for n := 0; n < 2000; n++ {
+					i := r.Intn(1000)
+					value, err := db.Get([]byte("key" + strconv.Itoa(i)))
+					if err != nil {
+						t.Errorf("could not get key: %s", err)
+						return
+					}
+
+					if string(value) != strings.Repeat(strconv.Itoa(i), 10) {
+						t.Errorf("wrong value for key%d. got=%s", i, string(value))
+						return
+					}
+				}
+			}(worker)
+		}
+
+		// writes to other keys happen at the same time as the reads.
+		for i := 0; i < 200; i++ {
+			if err := db.Put([]byte("other"+strconv.Itoa(i)), []byte("value")); err != nil {
+				t.Fatalf("error putting value into database: %s", err)
+			}
+		}
+		wg.Wait()
+
+		db.Close()
+		os.RemoveAll(db.GetDirectory())
+	}
+}
+
+func TestMmapReads(t *testing.T) {
+	db := createTestDatabaseWithOptions(t, &bitcask.Options{
+		MaxDatafileSize: 1024,
+		VerifyChecksums: true,
+		MmapReads:       true,
+	})
+
+	for i := 0; i < 100; i++ {
+		if err := db.Put([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("error putting value into database: %s", err)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		value, err := db.Get([]byte("key" + strconv.Itoa(i)))
+		if err != nil {
+			t.Fatalf("could not get key: %s", err)
+		}
+
+		if string(value) != "value"+strconv.Itoa(i) {
+			t.Errorf("wrong value. got=%s want=%s", string(value), "value"+strconv.Itoa(i))
+		}
+	}
+
+	// overwrite the keys such that the merge removes the datafile the view points to.
+	for i := 0; i < 100; i++ {
+		if err := db.Put([]byte("key"+strconv.Itoa(i)), []byte("changed")); err != nil {
+			t.Fatalf("error putting value into database: %s", err)
+		}
+	}
+
+	if err := db.Put([]byte("viewed"), []byte("value")); err != nil {
+		t.Fatalf("error putting value into database: %s", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if err := db.Put([]byte("filler"+strconv.Itoa(i)), []byte("value")); err != nil {
+			t.Fatalf("error putting value into database: %s", err)
+		}
+	}
+
+	if err := db.View([]byte("viewed"), func(value []byte) error {
+		if err := db.Put([]byte("viewed"), []byte("changed")); err != nil {
+			return err
+		}
+
+		for i := 0; i < 100; i++ {
+			if err := db.Put([]byte("filler"+strconv.Itoa(i)), []byte("changed")); err != nil {
+				return err
+			}
+		}
+
+		if err := db.Merge(); err != nil {
+			return err
+		}
+
+		if string(value) != "value" {
+			t.Errorf("the view changed after merge. got=%s", string(value))
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("could not view key: %s", err)
+	}
+
+	value, err := db.Get([]byte("viewed"))
+	if err != nil || string(value) != "changed" {
+		t.Errorf("wrong value after merge. got=%s err=%v", string(value), err)
+	}
+}
+
+func TestValueCache(t *testing.T) {
+	db := createTestDatabaseWithOptions(t, &bitcask.Options{
+		MaxDatafileSize: 1024,
+		VerifyChecksums: true,
+		ValueCacheBytes: 1 << 20,
+	})
+
+	for i := 0; i < 100; i++ {
+		if err := db.Put([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("error putting value into database: %s", err)
+		}
+	}
+
+	// the first round fills the cache and the second one reads from it.
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 100; i++ {
+			value, err := db.Get([]byte("key" + strconv.Itoa(i)))
+			if err != nil {
+				t.Fatalf("could not get key: %s", err)
+			}
+
+			if string(value) != "value"+strconv.Itoa(i) {
+				t.Errorf("wrong value. got=%s want=%s", string(value), "value"+strconv.Itoa(i))
+			}
+		}
+	}
+
+	if stats := db.CacheStats(); stats.Hits != 100 || stats.Misses != 100 || stats.Items != 100 {
+		t.Errorf("wrong cache stats. got=%+v", stats)
+	}
+
+	// overwrite every other key, so that the merge moves the rest of the values to new offsets.
+	for i := 0; i < 100; i += 2 {
+		if err := db.Put([]byte("key"+strconv.Itoa(i)), []byte("changed")); err != nil {
+			t.Fatalf("error putting value into database: %s", err)
+		}
+	}
+
+	if err := db.Delete([]byte("key1")); err != nil {
+		t.Fatalf("error deleting key: %s", err)
+	}
+
+	if err := db.Merge(); err != nil {
+		t.Fatalf("error merging: %s", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		value, err := db.Get([]byte("key" + strconv.Itoa(i)))
+		if i == 1 {
+			if err != bitcask.ErrKeyNotFound {
+				t.Errorf("deleted key was found. err=%v", err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("could not get key: %s", err)
+		}
+
+		want := "value" + strconv.Itoa(i)
+		if i%2 == 0 {
+			want = "changed"
+		}
+
+		if string(value) != want {
+			t.Errorf("wrong value. got=%s want=%s", string(value), want)
+		}
+	}
+}
+
+func TestPutWithTTL(t *testing.T) {
+	options := &bitcask.Options{
+		MaxDatafileSize:     1024,
+		VerifyChecksums:     true,
+		ExpirySweepInterval: 50 * time.Millisecond,
+	}
+	db := createTestDatabaseWithOptions(t, options)
+
+	if err := db.PutWithTTL([]byte("key"), []byte("value"), 0); err != bitcask.ErrInvalidTTL {
+		t.Errorf("expected an invalid ttl error. got=%v", err)
+	}
+
+	// the older value is in an older datafile, so it must not come back after the merge.
+	if err := db.Put([]byte("session"), []byte("old")); err != nil {
+		t.Fatalf("error putting value into database: %s", err)
+	}
+
+	for i := 0; i < 50; i++ {
+		if err := db.Put([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("error putting value into database: %s", err)
+		}
+	}
+
+	if err := db.PutWithTTL([]byte("session"), []byte("new"), time.Second); err != nil {
+		t.Fatalf("error putting value into database: %s", err)
+	}
+
+	if err := db.PutWithTTL([]byte("forever"), []byte("value"), time.Hour); err != nil {
+		t.Fatalf("error putting value into database: %s", err)
+	}
+
+	for i := 50; i < 100; i++ {
+		if err := db.Put([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("error putting value into database: %s", err)
+		}
+	}
+
+	if value, err := db.Get([]byte("session")); err != nil || string(value) != "new" {
+		t.Fatalf("wrong value before expiry. got=%s err=%v", string(value), err)
+	}
+
+	// the expiry is rounded up to the next second.
+	time.Sleep(2100 * time.Millisecond)
+
+	if _, err := db.Get([]byte("session")); err != bitcask.ErrKeyNotFound {
+		t.Errorf("expired key was found. err=%v", err)
+	}
+
+	if db.KeyDir.Get("session") != nil {
+		t.Errorf("the expired key was not removed by the sweeper")
+	}
+
+	if err := db.Keys(func(key []byte) error {
+		if string(key) == "session" {
+			t.Errorf("expired key was iterated")
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("error iterating keys: %s", err)
+	}
+
+	if err := db.Merge(); err != nil {
+		t.Fatalf("error merging: %s", err)
+	}
+	db.Close()
+
+	db, err := bitcask.Open("./data", options)
+	if err != nil {
+		t.Fatalf("could not open the database: %s", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Get([]byte("session")); err != bitcask.ErrKeyNotFound {
+		t.Errorf("expired key was found after merge. err=%v", err)
+	}
+
+	if value, err := db.Get([]byte("forever")); err != nil || string(value) != "value" {
+		t.Errorf("wrong value for a key that hasn't expired. got=%s err=%v", string(value), err)
+	}
+
+	for i := 0; i < 100; i++ {
+		value, err := db.Get([]byte("key" + strconv.Itoa(i)))
+		if err != nil {
+			t.Fatalf("could not get key: %s", err)
+		}
+
+		if string(value) != "value"+strconv.Itoa(i) {
+			t.Errorf("wrong value. got=%s want=%s", string(value), "value"+strconv.Itoa(i))
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	value := []byte(strings.Repeat(`{"name":"value","count":10}`, 20))
+
+	options := &bitcask.Options{
+		MaxDatafileSize:      1024,
+		VerifyChecksums:      true,
+		MmapReads:            true,
+		Compression:          compress.Gzip(gzip.DefaultCompression),
+		CompressionThreshold: 64,
+	}
+	db := createTestDatabaseWithOptions(t, options)
+
+	for i := 0; i < 50; i++ {
+		if err := db.Put([]byte("key"+strconv.Itoa(i)), value); err != nil {
+			t.Fatalf("error putting value into database: %s", err)
+		}
+	}
+
+	if err := db.Put([]byte("small"), []byte("value")); err != nil {
+		t.Fatalf("error putting value into database: %s", err)
+	}
+
+	if entry := db.KeyDir.Get("key0"); entry.Codec != compress.CodecGzip || entry.ValSize >= uint32(len(value)) {
+		t.Errorf("the value was not compressed. got=%+v", entry)
+	}
+
+	if entry := db.KeyDir.Get("small"); entry.Codec != compress.CodecNone {
+		t.Errorf("a value under the threshold was compressed. got=%+v", entry)
+	}
+	db.Close()
+
+	// the values compressed with the built-in compressors can be read without compression, and the
+	// new values are written uncompressed.
+	options.Compression = nil
+	db, err := bitcask.Open("./data", options)
+	if err != nil {
+		t.Fatalf("could not open the database: %s", err)
+	}
+	defer db.Close()
+
+	for i := 50; i < 100; i++ {
+		if err := db.Put([]byte("key"+strconv.Itoa(i)), value); err != nil {
+			t.Fatalf("error putting value into database: %s", err)
+		}
+	}
+
+	if err := db.Merge(); err != nil {
+		t.Fatalf("error merging: %s", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		got, err := db.Get([]byte("key" + strconv.Itoa(i)))
+		if err != nil {
+			t.Fatalf("could not get key: %s", err)
+		}
+
+		if !bytes.Equal(got, value) {
+			t.Errorf("wrong value for key%d", i)
+		}
+
+		if err := db.View([]byte("key"+strconv.Itoa(i)), func(got []byte) error {
+			if !bytes.Equal(got, value) {
+				t.Errorf("wrong value in view for key%d", i)
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("could not view key: %s", err)
+		}
+	}
+
+	if value, err := db.Get([]byte("small")); err != nil || string(value) != "value" {
+		t.Errorf("wrong small value. got=%s err=%v", string(value), err)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+
+	options := &bitcask.Options{
+		MaxDatafileSize: 1024,
+		VerifyChecksums: true,
+		MmapReads:       true,
+		EncryptionKey:   oldKey,
+	}
+	db := createTestDatabaseWithOptions(t, options)
+
+	for i := 0; i < 50; i++ {
+		if err := db.Put([]byte("secretkey"+strconv.Itoa(i)), []byte("secretvalue"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("error putting value into database: %s", err)
+		}
+	}
+
+	if err := db.Delete([]byte("secretkey0")); err != nil {
+		t.Fatalf("error deleting key: %s", err)
+	}
+	db.Close()
+
+	files, err := filepath.Glob("./data/*")
+	if err != nil {
+		t.Fatalf("could not list files: %s", err)
+	}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("could not read file: %s", err)
+		}
+
+		if bytes.Contains(data, []byte("secret")) {
+			t.Errorf("file %s contains plaintext data", file)
+		}
+	}
+
+	// the files can't be read without the key or with the wrong key.
+	for _, key := range [][]byte{nil, newKey} {
+		if db, err := bitcask.Open("./data", &bitcask.Options{EncryptionKey: key}); !errors.Is(err, encryption.ErrUnknownKey) {
+			if err == nil {
+				db.Close()
+			}
+			t.Fatalf("expected an unknown key error. got=%v", err)
+		}
+	}
+
+	// rotate the key by merging with the old key given.
+	options.EncryptionKey = newKey
+	options.OldEncryptionKeys = [][]byte{oldKey}
+	db, err = bitcask.Open("./data", options)
+	if err != nil {
+		t.Fatalf("could not open the database: %s", err)
+	}
+
+	if err := db.Merge(); err != nil {
+		t.Fatalf("error merging: %s", err)
+	}
+	db.Close()
+
+	// the key directory is rebuilt from the datafiles when the hint files are missing.
+	hints, _ := filepath.Glob("./data/*.hnt")
+	for _, hint := range hints {
+		os.Remove(hint)
+	}
+
+	options.OldEncryptionKeys = nil
+	db, err = bitcask.Open("./data", options)
+	if err != nil {
+		t.Fatalf("could not open the database with only the new key: %s", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Get([]byte("secretkey0")); err != bitcask.ErrKeyNotFound {
+		t.Errorf("a deleted key was found. err=%v", err)
+	}
+
+	for i := 1; i < 50; i++ {
+		want := "secretvalue" + strconv.Itoa(i)
+		got, err := db.Get([]byte("secretkey" + strconv.Itoa(i)))
+		if err != nil || string(got) != want {
+			t.Errorf("wrong value. got=%s want=%s err=%v", string(got), want, err)
+		}
+
+		if err := db.View([]byte("secretkey"+strconv.Itoa(i)), func(got []byte) error {
+			if string(got) != want {
+				t.Errorf("wrong value in view. got=%s want=%s", string(got), want)
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("could not view key: %s", err)
+		}
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	db := createTestDatabaseWithOptions(t, &bitcask.Options{
+		MaxDatafileSize: 1024,
+		MaxKeySize:      8,
+		MaxValueSize:    16,
+	})
+
+	large := []byte(strings.Repeat("a", 17))
+
+	if err := db.Put(nil, []byte("value")); err != bitcask.ErrEmptyKey {
+		t.Errorf("expected an empty key error. got=%v", err)
+	}
+
+	if err := db.Put([]byte("too large key"), []byte("value")); !errors.Is(err, bitcask.ErrKeyTooLarge) {
+		t.Errorf("expected a key too large error. got=%v", err)
+	}
+
+	if err := db.PutWithTTL([]byte("key"), large, time.Minute); !errors.Is(err, bitcask.ErrValueTooLarge) {
+		t.Errorf("expected a value too large error. got=%v", err)
+	}
+
+	if err := db.Delete([]byte{}); err != bitcask.ErrEmptyKey {
+		t.Errorf("expected an empty key error. got=%v", err)
+	}
+
+	// nothing in the batch is written if one of the writes is too large.
+	b := bitcask.NewBatch()
+	b.Put([]byte("key"), []byte("value"))
+	b.Put([]byte("key2"), large)
+	if err := db.Write(b); !errors.Is(err, bitcask.ErrValueTooLarge) {
+		t.Errorf("expected a value too large error. got=%v", err)
+	}
+
+	if _, err := db.Get([]byte("key")); err != bitcask.ErrKeyNotFound {
+		t.Errorf("a write from a failed batch was found. err=%v", err)
+	}
+
+	txn := db.Begin()
+	if err := txn.Put([]byte("too large key"), nil); !errors.Is(err, bitcask.ErrKeyTooLarge) {
+		t.Errorf("expected a key too large error. got=%v", err)
+	}
+	txn.Discard()
+
+	// the limits are inclusive.
+	if err := db.Put([]byte("maxsized"), large[:16]); err != nil {
+		t.Fatalf("error putting value into database: %s", err)
+	}
+
+	if value, err := db.Get([]byte("maxsized")); err != nil || !bytes.Equal(value, large[:16]) {
+		t.Errorf("wrong value. got=%s err=%v", string(value), err)
+	}
+}
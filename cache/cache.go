@@ -0,0 +1,145 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// entryOverhead is a rough estimate of the memory each cached value takes in addition to the value
+// itself. It is counted towards the capacity, so a cache full of tiny values doesn't grow forever.
+const entryOverhead = 64
+
+// Key identifies a value by its location in the datafiles. The values at a location never change,
+// unless the datafile is rewritten by a merge.
+type Key struct {
+	FileID uint32
+	Offset int64
+}
+
+// Stats contains the counters of a cache.
+type Stats struct {
+	Hits   uint64
+	Misses uint64
+
+	// Items is the amount of cached values and Bytes is the amount of bytes they take.
+	Items int
+	Bytes int64
+}
+
+type entry struct {
+	key   Key
+	value []byte
+}
+
+// LRU is a least recently used cache of values with a limit on the total size of the values. It
+// is safe to use from multiple goroutines.
+type LRU struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	items    map[Key]*list.Element
+	order    *list.List
+
+	hits   uint64
+	misses uint64
+}
+
+// New creates a new cache that holds at most capacity bytes.
+func New(capacity int64) *LRU {
+	return &LRU{
+		capacity: capacity,
+		items:    make(map[Key]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func entrySize(value []byte) int64 {
+	return int64(len(value) + entryOverhead)
+}
+
+// Get returns a copy of the cached value with a given key.
+func (c *LRU) Get(key Key) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(elem)
+
+	value := elem.Value.(*entry).value
+	return append([]byte(nil), value...), true
+}
+
+// Add places a copy of the value into the cache and evicts the least recently used values if
+// the cache grows too large. Values larger than the whole cache are not cached.
+func (c *LRU) Add(key Key, value []byte) {
+	size := entrySize(value)
+	if size > c.capacity {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.removeElement(elem)
+	}
+
+	elem := c.order.PushFront(&entry{
+		key:   key,
+		value: append([]byte(nil), value...),
+	})
+	c.items[key] = elem
+	c.size += size
+
+	for c.size > c.capacity {
+		c.removeElement(c.order.Back())
+	}
+}
+
+// Remove removes the value with a given key from the cache.
+func (c *LRU) Remove(key Key) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+// RemoveFile removes all of the values of a datafile from the cache.
+func (c *LRU) RemoveFile(fileID uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, elem := range c.items {
+		if key.FileID == fileID {
+			c.removeElement(elem)
+		}
+	}
+}
+
+// removeElement removes an element from the cache. The caller needs to hold the lock.
+func (c *LRU) removeElement(elem *list.Element) {
+	e := elem.Value.(*entry)
+	c.order.Remove(elem)
+	delete(c.items, e.key)
+	c.size -= entrySize(e.value)
+}
+
+// Stats returns the hit and miss counters and the current size of the cache.
+func (c *LRU) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return Stats{
+		Hits:   c.hits,
+		Misses: c.misses,
+		Items:  len(c.items),
+		Bytes:  c.size,
+	}
+}
@@ -0,0 +1,53 @@
+package cache_test
+
+import (
+	"testing"
+
+	"github.com/nireo/bitcask/cache"
+)
+
+func TestEviction(t *testing.T) {
+	// room for two 36 byte values with the overhead.
+	c := cache.New(200)
+	value := make([]byte, 36)
+
+	c.Add(cache.Key{FileID: 1, Offset: 0}, value)
+	c.Add(cache.Key{FileID: 1, Offset: 100}, value)
+
+	// make the first value the most recently used one.
+	if _, ok := c.Get(cache.Key{FileID: 1, Offset: 0}); !ok {
+		t.Fatalf("value was not found in the cache")
+	}
+
+	c.Add(cache.Key{FileID: 2, Offset: 0}, value)
+
+	if _, ok := c.Get(cache.Key{FileID: 1, Offset: 100}); ok {
+		t.Errorf("the least recently used value was not evicted")
+	}
+
+	if _, ok := c.Get(cache.Key{FileID: 1, Offset: 0}); !ok {
+		t.Errorf("a recently used value was evicted")
+	}
+
+	c.RemoveFile(1)
+	if _, ok := c.Get(cache.Key{FileID: 1, Offset: 0}); ok {
+		t.Errorf("value of a removed file was found")
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 2 || stats.Misses != 2 || stats.Items != 1 || stats.Bytes != 100 {
+		t.Errorf("wrong stats. got=%+v", stats)
+	}
+}
+
+func TestReturnsCopy(t *testing.T) {
+	c := cache.New(1024)
+	c.Add(cache.Key{}, []byte("hello"))
+
+	value, _ := c.Get(cache.Key{})
+	value[0] = 'j'
+
+	if value, _ := c.Get(cache.Key{}); string(value) != "hello" {
+		t.Errorf("the cached value was modified. got=%s", string(value))
+	}
+}
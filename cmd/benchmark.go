@@ -7,6 +7,7 @@ import (
 	"math/rand"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/nireo/bitcask"
@@ -14,6 +15,8 @@ import (
 
 var amount = flag.Int("amount", 10000, "the amount of items to write and get from the database")
 var testRead = flag.Bool("read", false, "if the program should also benchmark reading the values")
+var workers = flag.Int("workers", 1, "the amount of goroutines writing to the database concurrently")
+var syncWrites = flag.Bool("sync", false, "if every write should be synced to disk")
 
 func init() {
 	flag.Parse()
@@ -21,21 +24,37 @@ func init() {
 
 func main() {
 	rand.Seed(time.Now().UnixNano())
-	db, err := bitcask.Open("./benchmark", nil)
+	options := bitcask.DefaultConfigurtion()
+	if *syncWrites {
+		options.SyncPolicy = bitcask.SyncAlways
+	}
+
+	db, err := bitcask.Open("./benchmark", options)
 	if err != nil {
 		log.Fatalf("could not start database")
 	}
 	defer db.Close()
 
-	startTime := time.Now()
 	keys := []string{}
 	for i := 0; i < *amount; i++ {
-		randString := strconv.Itoa(rand.Int())
-		if err := db.Put([]byte(randString), []byte("val-"+randString)); err != nil {
-			fmt.Printf("could not write value %s\n", randString)
-		}
-		keys = append(keys, randString)
+		keys = append(keys, strconv.Itoa(rand.Int()))
+	}
+
+	// split the keys between the workers.
+	startTime := time.Now()
+	var wg sync.WaitGroup
+	for w := 0; w < *workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(keys); i += *workers {
+				if err := db.Put([]byte(keys[i]), []byte("val-"+keys[i])); err != nil {
+					fmt.Printf("could not write value %s\n", keys[i])
+				}
+			}
+		}(w)
 	}
+	wg.Wait()
 
 	log.Printf("writes took %v", time.Since(startTime))
 
@@ -0,0 +1,136 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+const (
+	// CodecNone is the codec of values that are not compressed.
+	CodecNone byte = iota
+
+	// CodecFlate is the codec of the values compressed by Flate.
+	CodecFlate
+
+	// CodecGzip is the codec of the values compressed by Gzip.
+	CodecGzip
+
+	// MaxCodec is the largest codec that can be stored in a record. Custom compressors should use
+	// the codecs between CodecGzip and MaxCodec.
+	MaxCodec byte = 7
+)
+
+// Compressor compresses and decompresses values. The codec of the compressor is stored in each
+// record it compresses, so the same codec must always mean the same compression format. The
+// methods are called concurrently by the readers and the writers.
+type Compressor interface {
+	// Codec returns the codec stored in the records compressed by the compressor.
+	Codec() byte
+
+	Compress(value []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// streamCompressor implements Compressor with one of the stream compressors from the standard
+// library. The writers are reused, since creating a flate writer allocates a lot of memory.
+type streamCompressor struct {
+	codec   byte
+	writers sync.Pool
+
+	newWriter func(w io.Writer) (writer, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+// writer is implemented by both flate.Writer and gzip.Writer.
+type writer interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// Flate returns a compressor that uses the deflate format with the given compression level. The
+// levels are the same as in compress/flate.
+func Flate(level int) Compressor {
+	return &streamCompressor{
+		codec: CodecFlate,
+		newWriter: func(w io.Writer) (writer, error) {
+			return flate.NewWriter(w, level)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+	}
+}
+
+// Gzip returns a compressor that uses the gzip format with the given compression level. The
+// levels are the same as in compress/gzip.
+func Gzip(level int) Compressor {
+	return &streamCompressor{
+		codec: CodecGzip,
+		newWriter: func(w io.Writer) (writer, error) {
+			return gzip.NewWriterLevel(w, level)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	}
+}
+
+var (
+	defaultFlate = Flate(flate.DefaultCompression)
+	defaultGzip  = Gzip(gzip.DefaultCompression)
+)
+
+// Lookup returns a compressor that can decompress the values with one of the built-in codecs.
+func Lookup(codec byte) (Compressor, bool) {
+	switch codec {
+	case CodecFlate:
+		return defaultFlate, true
+	case CodecGzip:
+		return defaultGzip, true
+	default:
+		return nil, false
+	}
+}
+
+func (c *streamCompressor) Codec() byte {
+	return c.codec
+}
+
+func (c *streamCompressor) Compress(value []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	w, ok := c.writers.Get().(writer)
+	if ok {
+		w.Reset(&buffer)
+	} else {
+		var err error
+		if w, err = c.newWriter(&buffer); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	c.writers.Put(w)
+
+	return buffer.Bytes(), nil
+}
+
+func (c *streamCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := c.newReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,47 @@
+package compress_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"strings"
+	"testing"
+
+	"github.com/nireo/bitcask/compress"
+)
+
+func TestCompressors(t *testing.T) {
+	value := []byte(strings.Repeat(`{"name":"value"}`, 100))
+
+	for _, c := range []compress.Compressor{compress.Flate(flate.BestSpeed), compress.Gzip(flate.BestCompression)} {
+		// the writers are reused, so compress the value twice.
+		for i := 0; i < 2; i++ {
+			compressed, err := c.Compress(value)
+			if err != nil {
+				t.Fatalf("could not compress value: %s", err)
+			}
+
+			if len(compressed) >= len(value) {
+				t.Errorf("the value was not compressed. got=%d bytes", len(compressed))
+			}
+
+			// any compressor with the same codec can decompress the value.
+			decoder, ok := compress.Lookup(c.Codec())
+			if !ok {
+				t.Fatalf("built-in codec %d was not found", c.Codec())
+			}
+
+			decompressed, err := decoder.Decompress(compressed)
+			if err != nil {
+				t.Fatalf("could not decompress value: %s", err)
+			}
+
+			if !bytes.Equal(decompressed, value) {
+				t.Errorf("the values don't match")
+			}
+		}
+	}
+
+	if _, ok := compress.Lookup(compress.CodecNone); ok {
+		t.Errorf("found a compressor for uncompressed values")
+	}
+}
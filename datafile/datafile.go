@@ -1,25 +1,33 @@
 package datafile
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/nireo/bitcask/compress"
 	"github.com/nireo/bitcask/encoder"
+	"github.com/nireo/bitcask/encryption"
 	"github.com/nireo/bitcask/hint"
 	"github.com/nireo/bitcask/keydir"
+	"github.com/nireo/bitcask/utils"
 )
 
 var (
-	ErrWrongByteCount = errors.New("wrote wrong amount of bytes to file.")
-	ErrNoFileID       = errors.New("the filename didn't contain a fileid")
-	ErrNotInManager   = errors.New("the given id was not found in the manager")
+	ErrWrongByteCount  = errors.New("wrote wrong amount of bytes to file.")
+	ErrNoFileID        = errors.New("the filename didn't contain a fileid")
+	ErrNotInManager    = errors.New("the given id was not found in the manager")
+	ErrIncompleteBatch = errors.New("the batch was not committed")
+	ErrCorruptedEntry  = errors.New("a corrupt entry is followed by valid entries")
 )
 
 // DatafileManager takes care of managing read-only instances of datafiles.
@@ -66,64 +74,255 @@ func (dfm *DatafileManager) Get(id uint32) *Datafile {
 // a hint file which contains less information about the pairs to lower start-up time.
 type Datafile struct {
 	file *os.File
-	id   uint32 // id is the unix timestamp in uint32 form
+	id   uint32 // id grows by one for each new datafile
 
 	// we need this such that we can easily create key metadata.
 	offset int64
 
 	hintFile *hint.HintFile
+
+	// headerSize is the size of the entry headers, which depends on the format version of the file.
+	headerSize int64
+
+	// compressor compresses the appended values that are at least threshold bytes long. It is nil
+	// if the values are not compressed.
+	compressor compress.Compressor
+	threshold  int
+
+	// cipher encrypts the keys and values in the datafile. It is nil if the datafile is not
+	// encrypted.
+	cipher *encryption.Cipher
+
+	// mapping is set if the datafile has been memory-mapped with Mmap.
+	mapping *mapping
 }
 
 // DatafileScanner contains a bufio.Scanner that has a certain Split method specified to properly
 // go through the entries in a simple fashion.
 type DatafileScanner struct {
-	file   *os.File
-	offset int64
-	amount int
+	file       *os.File
+	offset     int64
+	amount     int
+	headerSize int
+
+	// cipher decrypts the entries. Without it the entries are returned as they are stored.
+	cipher *encryption.Cipher
+
+	// pending contains the rest of the entries of a committed batch.
+	pending []*Entry
 }
 
 // Entry represents all of the data in a datafile entry excluding the CRC32 hash, since that
 // is checked before creating an entry instance.
 type Entry struct {
 	Timestamp uint32
+
+	// KeySize and ValueSize are the sizes of the key and value in the datafile. For an encrypted
+	// entry they are larger than the decrypted key and value.
 	KeySize   uint32
 	ValueSize uint32
 
 	Key   []byte
 	Value []byte
+
+	// storedKey is the key as it is stored in the datafile. It is used for the hint file.
+	storedKey []byte
+
+	// ValOffset is the offset of the value in the datafile. It is set by the scanner such
+	// that the entry can be compared against the key directory.
+	ValOffset int64
+
+	// Tombstone is set for entries that delete a key.
+	Tombstone bool
+
+	// Batch is set for entries that are written as a part of a batch. The batch needs to be
+	// followed by a commit entry created with CommitEntry. The scanner only returns the entries
+	// of committed batches and it clears the flag from them.
+	Batch bool
+
+	// Commit is set for the entry that commits a batch. Commit entries are never returned by
+	// the scanner.
+	Commit bool
+
+	// Expiry is the unix time after which the entry has expired. Zero means that the entry never
+	// expires.
+	Expiry uint32
+
+	// Codec is the compression codec of the value. The scanner returns the values as they are
+	// stored, so compressed values need to be decompressed by the caller.
+	Codec byte
+
+	// sealedKey and sealedValue are the key and the value encrypted by Seal with sealedWith.
+	sealedKey, sealedValue []byte
+	sealedWith             *encryption.Cipher
+}
+
+// Seal encrypts the key and the value of the entry with c ahead of time, so AppendEntries doesn't
+// need to encrypt them. The value needs to be compressed before sealing, since a sealed entry is
+// not compressed by the datafile. If the entry is appended to a datafile with another cipher, it
+// is encrypted again.
+func (e *Entry) Seal(c *encryption.Cipher) error {
+	if c == nil {
+		return nil
+	}
+
+	key, value, err := seal(c, e, e.Value)
+	if err != nil {
+		return err
+	}
+	e.sealedKey, e.sealedValue, e.sealedWith = key, value, c
+
+	return nil
+}
+
+// CommitEntry creates the entry that commits a batch of count entries. It needs to be written
+// right after the entries of the batch.
+func CommitEntry(count int, timestamp uint32) *Entry {
+	return &Entry{
+		Timestamp: timestamp,
+		ValueSize: 4,
+		Value:     encoder.EncodeBatchCount(uint32(count)),
+		Commit:    true,
+	}
+}
+
+// flags returns the flags that are stored in the header of the entry.
+func (e *Entry) flags() byte {
+	var flags byte
+	if e.Tombstone {
+		flags |= encoder.FlagTombstone
+	}
+
+	if e.Batch {
+		flags |= encoder.FlagBatch
+	}
+
+	if e.Commit {
+		flags |= encoder.FlagBatchCommit
+	}
+
+	return flags | encoder.CodecFlags(e.Codec)
 }
 
 func (df *Datafile) GetPath(directory string) string {
 	return df.file.Name()
 }
 
-// NewDatafile creates a new datafile into a given directory. It also creates a fileid
-// that is the current unix timestamp.
+// Path returns the path of the datafile with a given id in a directory.
+func Path(directory string, id uint32) string {
+	return filepath.Join(directory, fmt.Sprintf("%d.df", id))
+}
+
+// NewDatafile creates a new datafile into a given directory. The id of the datafile is one larger
+// than the largest id in the directory.
 func NewDatafile(directory string) (*Datafile, error) {
-	timestamp := uint32(time.Now().Unix())
-	path := filepath.Join(directory, fmt.Sprintf("%d.df", timestamp))
+	id, err := NextID(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewDatafileWithID(directory, id, nil)
+}
+
+// NewDatafileWithID creates a new datafile with a given id into a directory. An error is returned
+// if a datafile with the id already exists, so existing data is never overwritten. The keys and
+// values are encrypted with the cipher unless it is nil.
+func NewDatafileWithID(directory string, id uint32, c *encryption.Cipher) (*Datafile, error) {
+	f, err := os.OpenFile(Path(directory, id), os.O_CREATE|os.O_EXCL|os.O_RDWR, 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeHeader(f, id, keyID(c)); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	hintFile, err := hint.NewHintFileWithPath(hint.Path(directory, id), id, keyID(c))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// make sure that the new files are still there after a crash.
+	if err := utils.SyncDirectory(directory); err != nil {
+		f.Close()
+		hintFile.Close()
+		return nil, err
+	}
+
+	return &Datafile{
+		offset:     encoder.FileHeaderSize,
+		id:         id,
+		file:       f,
+		hintFile:   hintFile,
+		headerSize: encoder.EntryHeaderSize,
+		cipher:     c,
+	}, nil
+}
 
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0777)
+// NextID returns an id that is larger than the id of any datafile or hint file in the directory.
+// The ids start from 1.
+func NextID(directory string) (uint32, error) {
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return 0, err
+	}
+
+	var maxID uint32
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".df") && !strings.HasSuffix(file.Name(), ".hnt") {
+			continue
+		}
+
+		id, err := ParseID(file.Name())
+		if err != nil {
+			continue
+		}
+
+		if id > maxID {
+			maxID = id
+		}
+	}
+
+	return maxID + 1, nil
+}
+
+// NewMergeDatafile creates a temporary datafile and hint file for the datafile with the given id.
+// The merge process writes the live entries into it and then renames it over the original files.
+// The entries are encrypted with the given cipher, so merging also changes the encryption key of
+// the datafile.
+func NewMergeDatafile(directory string, id uint32, c *encryption.Cipher) (*Datafile, error) {
+	f, err := os.OpenFile(Path(directory, id)+".tmp", os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0777)
 	if err != nil {
 		return nil, err
 	}
 
-	hintFile, err := hint.NewHintFile(directory, timestamp)
+	if err := writeHeader(f, id, keyID(c)); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	hintFile, err := hint.NewHintFileWithPath(hint.Path(directory, id)+".tmp", id, keyID(c))
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
 
 	return &Datafile{
-		offset:   0,
-		id:       timestamp,
-		file:     f,
-		hintFile: hintFile,
+		offset:     encoder.FileHeaderSize,
+		id:         id,
+		file:       f,
+		hintFile:   hintFile,
+		headerSize: encoder.EntryHeaderSize,
+		cipher:     c,
 	}, nil
 }
 
 // NewReadOnlyDatafile takes in a path for a datafile and then opens a read-only pointer to that file
 // This is done such the other datafiles cannot be written after the current datafile is changed.
-func NewReadOnlyDatafile(path string) (*Datafile, error) {
+// If the datafile is encrypted, its key needs to be in the keyring.
+func NewReadOnlyDatafile(path string, keyring encryption.Keyring) (*Datafile, error) {
 	f, err := os.OpenFile(path, os.O_RDONLY, 0777)
 	if err != nil {
 		return nil, err
@@ -131,19 +330,72 @@ func NewReadOnlyDatafile(path string) (*Datafile, error) {
 
 	fileID, err := ParseID(path)
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
 
+	version, id, err := readHeader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("invalid datafile %s: %w", path, err)
+	}
+
+	c, err := keyring.Get(id)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not open datafile %s: %w", path, err)
+	}
+
 	// no need to parse the hint file since a read-only file will not do anything
 	// with the hint file pointer.
 	return &Datafile{
-		offset:   0,
-		file:     f,
-		id:       fileID,
-		hintFile: nil,
+		offset:     0,
+		file:       f,
+		id:         fileID,
+		hintFile:   nil,
+		headerSize: int64(encoder.EntryHeaderSizeFor(version)),
+		cipher:     c,
 	}, nil
 }
 
+// writeHeader writes the file header into an empty datafile.
+func writeHeader(f *os.File, id uint32, keyID uint16) error {
+	header := encoder.EncodeFileHeaderWithKey(encoder.DatafileMagic, id, uint32(time.Now().Unix()), keyID)
+	_, err := f.Write(header)
+	return err
+}
+
+// readHeader reads and checks the file header at the start of a datafile. It returns the format
+// version of the datafile and the id of the key it is encrypted with.
+func readHeader(f *os.File) (uint16, uint16, error) {
+	header := make([]byte, encoder.FileHeaderSize)
+	nBytes, err := f.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+
+	_, _, version, err := encoder.DecodeFileHeaderVersion(header[:nBytes], encoder.DatafileMagic)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return version, encoder.DecodeFileKeyID(header), nil
+}
+
+// keyID returns the id of the key of a cipher, or zero if there is no cipher.
+func keyID(c *encryption.Cipher) uint16 {
+	if c == nil {
+		return 0
+	}
+
+	return c.ID()
+}
+
+// Encrypted returns true if the keys and values in the datafile are encrypted.
+func (df *Datafile) Encrypted() bool {
+	return df.cipher != nil
+}
+
 // ParseID parses the last number from a given path. We take the last number since the directory in
 // which the datafiles are held in could contain a number.
 func ParseID(path string) (uint32, error) {
@@ -163,7 +415,8 @@ func ParseID(path string) (uint32, error) {
 	return uint32(fileID), nil
 }
 
-// readOffset reads valueSize amount of bytes starting from offset in the datafile.
+// ReadOffset reads valueSize amount of bytes starting from offset in the datafile. The read doesn't
+// use the file offset, so it is safe to call from multiple goroutines at the same time.
 func (df *Datafile) ReadOffset(offset int64, valueSize uint32) ([]byte, error) {
 	// create a buffer of size valueSize and read that data starting from 'offset'
 	buffer := make([]byte, valueSize)
@@ -172,58 +425,255 @@ func (df *Datafile) ReadOffset(offset int64, valueSize uint32) ([]byte, error) {
 		return nil, errors.New("the datafile is not set")
 	}
 
-	if _, err := df.file.Seek(offset, 0); err != nil {
-		return nil, err
+	if df.mapping != nil && df.mapping.acquire() {
+		defer df.mapping.release()
+
+		data, err := df.mapping.slice(offset, valueSize)
+		if err != nil {
+			return nil, err
+		}
+		copy(buffer, data)
+
+		return buffer, nil
 	}
 
-	if _, err := df.file.Read(buffer); err != nil {
+	// ReadAt only returns less bytes than requested together with an error.
+	nBytes, err := df.file.ReadAt(buffer, offset)
+	if err == io.EOF && nBytes < len(buffer) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	if err != nil && err != io.EOF {
 		return nil, err
 	}
 
 	return buffer, nil
 }
 
-func (dfs *DatafileScanner) Scan() (*Entry, error) {
-	metaBuffer := make([]byte, 16, 16)
-	nBytes, err := dfs.file.ReadAt(metaBuffer, dfs.offset)
-	if err != nil && err != io.EOF {
+// ReadEntry reads the whole entry of a key whose value is at valOffset and checks the crc32
+// checksum of the entry. encoder.ErrChecksumMismatch is returned if the entry is corrupted. The
+// value is decrypted if the datafile is encrypted.
+func (df *Datafile) ReadEntry(key []byte, valOffset int64, valueSize uint32) ([]byte, error) {
+	data, err := df.ReadOffset(df.EntryOffset(key, valOffset), uint32(df.headerSize+df.storedKeySize(key))+valueSize)
+	if err != nil {
 		return nil, err
 	}
 
+	return df.checkEntry(data, key, valueSize)
+}
+
+// ReadValue reads the value of a key without checking the checksum of the entry. The value is
+// decrypted if the datafile is encrypted, which also verifies it.
+func (df *Datafile) ReadValue(key []byte, valOffset int64, valueSize uint32) ([]byte, error) {
+	value, err := df.ReadOffset(valOffset, valueSize)
+	if err != nil || df.cipher == nil || len(value) == 0 {
+		return value, err
+	}
+
+	return df.cipher.Open(value, key)
+}
+
+// EntryOffset returns the offset to the start of the entry of a key whose value is at valOffset.
+func (df *Datafile) EntryOffset(key []byte, valOffset int64) int64 {
+	return valOffset - df.headerSize - df.storedKeySize(key)
+}
+
+// EntryOverhead returns the amount of bytes an entry with a non-empty key takes in the datafile in
+// addition to its key and value. This contains the entry header and the encryption of the key.
+func (df *Datafile) EntryOverhead() int64 {
+	if df.cipher == nil {
+		return df.headerSize
+	}
+
+	return df.headerSize + encryption.Overhead
+}
+
+// storedKeySize returns the size of a key in the datafile.
+func (df *Datafile) storedKeySize(key []byte) int64 {
+	if df.cipher == nil || len(key) == 0 {
+		return int64(len(key))
+	}
+
+	return int64(len(key) + encryption.Overhead)
+}
+
+// checkEntry checks that a whole entry contains the given key and a value of the given size, and
+// that the crc32 checksum matches. It returns the value in the entry, which is not copied unless
+// the datafile is encrypted.
+func (df *Datafile) checkEntry(data, key []byte, valueSize uint32) ([]byte, error) {
+	keySize := df.storedKeySize(key)
+	meta := data[:df.headerSize]
+	storedKey := data[df.headerSize : df.headerSize+keySize]
+	value := data[df.headerSize+keySize:]
+
+	_, _, ksize, vsize, _ := encoder.DecodeEntryMeta(meta)
+	if int64(ksize) != keySize || vsize != valueSize || !encoder.VerifyEntry(meta, storedKey, value) {
+		return nil, encoder.ErrChecksumMismatch
+	}
+
+	if df.cipher == nil {
+		if !bytes.Equal(storedKey, key) {
+			return nil, encoder.ErrChecksumMismatch
+		}
+
+		return value, nil
+	}
+
+	// the value is authenticated together with the key, so the key only needs to be decrypted if
+	// there is no value.
+	if len(value) == 0 {
+		if decrypted, err := df.cipher.Open(storedKey, nil); err != nil || !bytes.Equal(decrypted, key) {
+			return nil, encoder.ErrChecksumMismatch
+		}
+
+		return value, nil
+	}
+
+	return df.cipher.Open(value, key)
+}
+
+// Scan reads the next entry from the datafile. It returns io.EOF when there are no more entries,
+// ErrWrongByteCount if the datafile ends in the middle of an entry and encoder.ErrChecksumMismatch
+// if the entry is corrupt. The entries of a batch are only returned once the whole batch has been
+// read, and ErrIncompleteBatch is returned if the batch wasn't committed. The scanner doesn't move
+// past an invalid entry or batch.
+func (dfs *DatafileScanner) Scan() (*Entry, error) {
+	if len(dfs.pending) > 0 {
+		entry := dfs.pending[0]
+		dfs.pending = dfs.pending[1:]
+		return entry, nil
+	}
+
+	// the file header is checked before reading the first entry.
+	if dfs.offset == 0 {
+		version, _, err := readHeader(dfs.file)
+		if err != nil {
+			return nil, err
+		}
+		dfs.offset = encoder.FileHeaderSize
+		dfs.headerSize = encoder.EntryHeaderSizeFor(version)
+	}
+
+	for {
+		entry, offset, err := dfs.readEntry(dfs.offset)
+		if err != nil {
+			return nil, err
+		}
+
+		// a commit without any entries before it doesn't change anything.
+		if entry.Commit {
+			dfs.offset = offset
+			continue
+		}
+
+		if !entry.Batch {
+			dfs.offset = offset
+			return entry, nil
+		}
+
+		batch, offset, err := dfs.readBatch(entry, offset)
+		if err != nil {
+			return nil, err
+		}
+		dfs.offset = offset
+		dfs.pending = batch[1:]
+
+		return batch[0], nil
+	}
+}
+
+// readBatch reads the rest of the batch that starts with first. It returns the entries of the
+// batch and the offset to the end of the commit entry.
+func (dfs *DatafileScanner) readBatch(first *Entry, offset int64) ([]*Entry, int64, error) {
+	batch := []*Entry{first}
+	for {
+		entry, next, err := dfs.readEntry(offset)
+		if err == io.EOF {
+			return nil, 0, ErrIncompleteBatch
+		}
+
+		if err != nil {
+			return nil, 0, err
+		}
+		offset = next
+
+		if entry.Commit {
+			count, ok := encoder.DecodeBatchCount(entry.Value)
+			if !ok || int(count) != len(batch) {
+				return nil, 0, ErrIncompleteBatch
+			}
+
+			for _, e := range batch {
+				e.Batch = false
+			}
+
+			return batch, offset, nil
+		}
+
+		// another entry was written before the batch was committed.
+		if !entry.Batch {
+			return nil, 0, ErrIncompleteBatch
+		}
+		batch = append(batch, entry)
+	}
+}
+
+// readEntry reads the entry starting from offset and returns it with the offset to the end of
+// the entry.
+func (dfs *DatafileScanner) readEntry(offset int64) (*Entry, int64, error) {
+	metaBuffer := make([]byte, dfs.headerSize)
+	nBytes, err := dfs.file.ReadAt(metaBuffer, offset)
 	// we are at the end of the file so we should stop reading.
-	if err == io.EOF {
-		return nil, io.EOF
+	if err == io.EOF && nBytes == 0 {
+		return nil, 0, io.EOF
+	}
+
+	if err != nil && err != io.EOF {
+		return nil, 0, err
 	}
 
 	// we didn't read enough bytes
-	if nBytes != 16 {
-		return nil, ErrWrongByteCount
+	if nBytes != dfs.headerSize {
+		return nil, 0, ErrWrongByteCount
 	}
-	dfs.offset += int64(nBytes)
+	offset += int64(nBytes)
 
-	_, timestamp, vsize, ksize := encoder.DecodeEntryMeta(metaBuffer)
+	_, timestamp, ksize, vsize, flags := encoder.DecodeEntryMeta(metaBuffer)
 	key := make([]byte, ksize)
 
-	nBytes, err = dfs.file.ReadAt(key, dfs.offset)
-	if err != nil {
-		return nil, err
+	nBytes, err = dfs.file.ReadAt(key, offset)
+	if err != nil && err != io.EOF {
+		return nil, 0, err
 	}
 
 	if nBytes != int(ksize) {
-		return nil, ErrWrongByteCount
+		return nil, 0, ErrWrongByteCount
 	}
-	dfs.offset += int64(nBytes)
+	offset += int64(nBytes)
+	valOffset := offset
 
 	value := make([]byte, vsize)
-	nBytes, err = dfs.file.ReadAt(value, dfs.offset)
-	if err != nil {
-		return nil, err
+	nBytes, err = dfs.file.ReadAt(value, offset)
+	if err != nil && err != io.EOF {
+		return nil, 0, err
 	}
 
 	if nBytes != int(vsize) {
-		return nil, ErrWrongByteCount
+		return nil, 0, ErrWrongByteCount
+	}
+	offset += int64(nBytes)
+
+	if !encoder.VerifyEntry(metaBuffer, key, value) {
+		return nil, 0, encoder.ErrChecksumMismatch
+	}
+
+	// commit entries are not encrypted, so the batches can be recovered without the key.
+	storedKey := key
+	if dfs.cipher != nil && flags&encoder.FlagBatchCommit == 0 {
+		if key, value, err = dfs.decrypt(key, value); err != nil {
+			return nil, 0, err
+		}
 	}
-	dfs.offset += int64(nBytes)
 
 	return &Entry{
 		Timestamp: timestamp,
@@ -231,48 +681,239 @@ func (dfs *DatafileScanner) Scan() (*Entry, error) {
 		ValueSize: vsize,
 		Key:       key,
 		Value:     value,
-	}, nil
+		storedKey: storedKey,
+		ValOffset: valOffset,
+		Tombstone: flags&encoder.FlagTombstone != 0,
+		Batch:     flags&encoder.FlagBatch != 0,
+		Commit:    flags&encoder.FlagBatchCommit != 0,
+		Expiry:    encoder.DecodeEntryExpiry(metaBuffer),
+		Codec:     encoder.DecodeCodec(flags),
+	}, offset, nil
+}
+
+// decrypt decrypts the key and value of an entry. Empty keys and values are not encrypted.
+func (dfs *DatafileScanner) decrypt(key, value []byte) ([]byte, []byte, error) {
+	var err error
+	if len(key) > 0 {
+		if key, err = dfs.cipher.Open(key, nil); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(value) > 0 {
+		if value, err = dfs.cipher.Open(value, key); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return key, value, nil
+}
+
+// Offset returns the offset to the end of the last entry that was read. When the scanner is in the
+// middle of a batch, the offset points to the end of the whole batch.
+func (dfs *DatafileScanner) Offset() int64 {
+	return dfs.offset
 }
 
 // write writes a key-value pair in to a datafile. It also returns key-metadata such that it is
 // easier to then append this key into the key-dir.
 func (df *Datafile) Write(key, value []byte) (*keydir.MemEntry, error) {
-	// construct the entry data
-	timestamp := uint32(time.Now().Unix())
-	asBytes := encoder.EncodeEntry(
-		key, value, timestamp,
-	)
+	return df.Append(&Entry{
+		Timestamp: uint32(time.Now().Unix()),
+		Key:       key,
+		Value:     value,
+	})
+}
+
+// WriteTombstone writes an entry that marks the key as deleted. The returned metadata should not be
+// added to the key directory, but it can be used to find the tombstone in the datafile.
+func (df *Datafile) WriteTombstone(key []byte) (*keydir.MemEntry, error) {
+	return df.Append(&Entry{
+		Timestamp: uint32(time.Now().Unix()),
+		Key:       key,
+		Tombstone: true,
+	})
+}
+
+// Append writes an already existing entry into the datafile while preserving its timestamp. This is
+// used when live entries are moved from one datafile to another during a merge.
+func (df *Datafile) Append(entry *Entry) (*keydir.MemEntry, error) {
+	mementries, err := df.AppendEntries([]*Entry{entry})
+	if err != nil {
+		return nil, err
+	}
+
+	return mementries[0], nil
+}
+
+// SetCompression makes the datafile compress the appended values that are at least threshold
+// bytes long. A value is stored uncompressed if compressing it doesn't make it smaller.
+func (df *Datafile) SetCompression(c compress.Compressor, threshold int) {
+	df.compressor = c
+	df.threshold = threshold
+}
+
+// compress returns the value that is written for an entry and the codec of the value.
+func (df *Datafile) compress(entry *Entry) ([]byte, byte, error) {
+	if entry.sealedWith != nil {
+		return entry.Value, entry.Codec, nil
+	}
+
+	return CompressValue(entry, df.compressor, df.threshold)
+}
+
+// CompressValue returns the value that is written for an entry and the codec of the value. The
+// value is compressed with c if it is at least threshold bytes long and compressing it makes it
+// smaller. Entries that already have a codec are returned as they are.
+func CompressValue(entry *Entry, c compress.Compressor, threshold int) ([]byte, byte, error) {
+	// the values of merged entries are already compressed.
+	if c == nil || entry.Codec != compress.CodecNone || entry.Tombstone || entry.Commit ||
+		len(entry.Value) < threshold {
+		return entry.Value, entry.Codec, nil
+	}
+
+	compressed, err := c.Compress(entry.Value)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(compressed) >= len(entry.Value) {
+		return entry.Value, compress.CodecNone, nil
+	}
+
+	return compressed, c.Codec(), nil
+}
+
+// encrypt encrypts the key and value of an entry if the datafile is encrypted. The value is
+// authenticated together with the key, so it can't be moved to another key. Empty keys and values
+// and commit entries are not encrypted.
+func (df *Datafile) encrypt(entry *Entry, value []byte) ([]byte, []byte, error) {
+	if df.cipher == nil {
+		return entry.Key, value, nil
+	}
+
+	if entry.sealedWith == df.cipher {
+		return entry.sealedKey, entry.sealedValue, nil
+	}
+
+	return seal(df.cipher, entry, value)
+}
+
+// seal encrypts the key of an entry and the given value with c.
+func seal(c *encryption.Cipher, entry *Entry, value []byte) ([]byte, []byte, error) {
+	key := entry.Key
+	if entry.Commit {
+		return key, value, nil
+	}
+
+	sealedKey, sealedValue := key, value
+	var err error
+	if len(key) > 0 {
+		if sealedKey, err = c.Seal(key, nil); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(value) > 0 {
+		if sealedValue, err = c.Seal(value, key); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return sealedKey, sealedValue, nil
+}
+
+// AppendEntries writes multiple entries into the datafile with a single write. The key metadata
+// is returned for each of the entries in the same order. The values are compressed if compression
+// has been set with SetCompression, and then encrypted if the datafile is encrypted.
+func (df *Datafile) AppendEntries(entries []*Entry) ([]*keydir.MemEntry, error) {
+	var data, hints []byte
+	mementries := make([]*keydir.MemEntry, len(entries))
+
+	offset := df.offset
+	for i, entry := range entries {
+		value, codec, err := df.compress(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		key, value, err := df.encrypt(entry, value)
+		if err != nil {
+			return nil, err
+		}
+
+		timestamp := entry.Timestamp
+		flags := entry.flags() | encoder.CodecFlags(codec)
+		data = append(data, encoder.EncodeEntryWithExpiry(
+			key, value, timestamp, entry.Expiry, flags,
+		)...)
+
+		valOffset := offset + encoder.EntryHeaderSize + int64(len(key))
+		hints = append(hints, encoder.EncodeHintWithExpiry(
+			timestamp, uint32(len(value)), valOffset, key, entry.Expiry, flags,
+		)...)
+
+		mementries[i] = &keydir.MemEntry{
+			Timestamp: timestamp,
+			ValOffset: valOffset,
+			ValSize:   uint32(len(value)),
+			FileID:    df.id,
+			Expiry:    entry.Expiry,
+			Codec:     codec,
+		}
+		offset = valOffset + int64(len(value))
+	}
 
-	nBytes, err := df.file.Write(asBytes)
+	// write at the offset such that a failed write gets overwritten by the next one.
+	nBytes, err := df.file.WriteAt(data, df.offset)
 	if err != nil {
 		return nil, err
 	}
 
-	sz := len(asBytes)
-	if sz != nBytes {
+	if nBytes != len(data) {
 		return nil, ErrWrongByteCount
 	}
 
-	if err := df.hintFile.Append(timestamp, uint32(len(value)), df.offset, key); err != nil {
+	if err := df.hintFile.AppendEncoded(hints); err != nil {
 		return nil, err
 	}
+	df.offset = offset
 
-	// now that we have stored the value offset we can add to it
-	valOffset := df.offset + 16 + int64(len(key))
-	df.offset += int64(sz)
+	return mementries, nil
+}
 
-	return &keydir.MemEntry{
-		Timestamp: timestamp,
-		ValOffset: valOffset,
-		ValSize:   uint32(len(value)),
-		FileID:    df.id,
-	}, nil
+// Sync flushes the datafile and its hint file to the disk.
+func (df *Datafile) Sync() error {
+	if err := df.file.Sync(); err != nil {
+		return err
+	}
+
+	if df.hintFile != nil {
+		return df.hintFile.Sync()
+	}
+
+	return nil
 }
 
-// Close closes the datafile file pointer and the hint pointer.
+// SyncData flushes only the datafile to the disk. The hint file can be rebuilt from the datafile
+// so it doesn't need to be synced after every write.
+func (df *Datafile) SyncData() error {
+	return df.file.Sync()
+}
+
+// Close closes the datafile file pointer and the hint pointer. A memory mapping is released once
+// all of the views into it have been released.
 func (df *Datafile) Close() {
 	df.file.Close()
-	df.hintFile.Close()
+
+	if df.mapping != nil {
+		df.mapping.close()
+	}
+
+	// read-only datafiles don't have a hint file
+	if df.hintFile != nil {
+		df.hintFile.Close()
+	}
 }
 
 // Offset returns offset to the end of the file.
@@ -280,16 +921,239 @@ func (df *Datafile) Offset() int64 {
 	return df.offset
 }
 
-// ID returns the id the datafile has. This ID is the timestamp of the time when the instance was created.
+// ID returns the id the datafile has. Newer datafiles always have larger ids.
 func (df *Datafile) ID() uint32 {
 	return df.id
 }
 
+// RebuildKeyDir scans through all of the entries in a datafile and adds them to the key directory.
+// This is used when the hint file of a datafile is missing or corrupt, so a new hint file is also
+// written such that the next startup can use it. If the datafile has an invalid entry, the entries
+// before it are still added and the error is returned, but the hint file is not written.
+func RebuildKeyDir(df *Datafile, directory string, kd *keydir.KeyDir) error {
+	hintPath := hint.Path(directory, df.id)
+	hintFile, err := hint.NewHintFileWithPath(hintPath+".tmp", df.id, keyID(df.cipher))
+	if err != nil {
+		return err
+	}
+
+	var scanErr error
+	scanner := InitDatafileScanner(df)
+	for {
+		entry, err := scanner.Scan()
+		if err == io.EOF {
+			break
+		}
+
+		// the key is wrong, so the hint file would be missing entries that are in the datafile.
+		if err == encryption.ErrDecrypt {
+			hintFile.Close()
+			os.Remove(hintPath + ".tmp")
+			return err
+		}
+
+		if err != nil {
+			scanErr = err
+			break
+		}
+
+		if err := hintFile.AppendEncoded(encoder.EncodeHintWithExpiry(
+			entry.Timestamp, entry.ValueSize, entry.ValOffset, entry.storedKey, entry.Expiry, entry.flags(),
+		)); err != nil {
+			hintFile.Close()
+			os.Remove(hintPath + ".tmp")
+			return err
+		}
+
+		if entry.Tombstone {
+			kd.DeleteWithTombstone(string(entry.Key), df.id)
+			continue
+		}
+
+		kd.Put(string(entry.Key), &keydir.MemEntry{
+			FileID:    df.id,
+			ValOffset: entry.ValOffset,
+			ValSize:   entry.ValueSize,
+			Timestamp: entry.Timestamp,
+			Expiry:    entry.Expiry,
+			Codec:     entry.Codec,
+		})
+	}
+
+	// a hint file without the entries after the invalid one would hide them on the next startup,
+	// so the datafile is scanned again every time.
+	if scanErr != nil {
+		hintFile.Close()
+		os.Remove(hintPath + ".tmp")
+		return scanErr
+	}
+
+	if err := hintFile.Sync(); err != nil {
+		hintFile.Close()
+		return err
+	}
+	hintFile.Close()
+
+	if err := os.Rename(hintPath+".tmp", hintPath); err != nil {
+		return err
+	}
+
+	return utils.SyncDirectory(directory)
+}
+
+// Recover truncates a datafile to the end of its last valid entry. A crash in the middle of a write
+// can leave a partial entry or an uncommitted batch at the end of the datafile, which would make the
+// scanning fail. The amount of bytes dropped from the datafile and the new size of the datafile are
+// returned. Only invalid entries that run to the end of the datafile are dropped. If a corrupt
+// entry is followed by valid entries, the datafile is left as it is and ErrCorruptedEntry is
+// returned with the offset of the corrupt entry in place of the size.
+func Recover(path string) (int64, int64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0777)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// the crash happened before the whole file header was written, so a new one is written.
+	if stat.Size() < encoder.FileHeaderSize {
+		id, err := ParseID(path)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if err := f.Truncate(0); err != nil {
+			return 0, 0, err
+		}
+
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return 0, 0, err
+		}
+
+		if err := writeHeader(f, id, 0); err != nil {
+			return 0, 0, err
+		}
+
+		return stat.Size(), encoder.FileHeaderSize, nil
+	}
+
+	scanner := &DatafileScanner{file: f}
+	for {
+		_, err := scanner.Scan()
+		if err == io.EOF {
+			return 0, stat.Size(), nil
+		}
+
+		if err == ErrWrongByteCount || err == encoder.ErrChecksumMismatch || err == ErrIncompleteBatch {
+			break
+		}
+
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	torn, err := scanner.tornTail(scanner.Offset(), stat.Size())
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if !torn {
+		return 0, scanner.Offset(), ErrCorruptedEntry
+	}
+
+	if err := f.Truncate(scanner.Offset()); err != nil {
+		return 0, 0, err
+	}
+
+	return stat.Size() - scanner.Offset(), scanner.Offset(), nil
+}
+
+// tornTail reports whether the invalid entry or batch starting from offset runs to the end of the
+// file, such that it can be the result of a write that was cut short. The entries are read without
+// decrypting them, so this only works on a scanner without a cipher.
+func (dfs *DatafileScanner) tornTail(offset, size int64) (bool, error) {
+	for {
+		entry, next, err := dfs.readEntry(offset)
+		if err == io.EOF {
+			return true, nil
+		}
+
+		// the entry is only torn if there are no valid entries after it. The sizes in the header
+		// might be corrupt, and the parts of a torn write that never reached the disk can read
+		// back as zeroes, so the rest of the file is searched for entries.
+		if err == ErrWrongByteCount || err == encoder.ErrChecksumMismatch {
+			found, err := dfs.validEntryAfter(offset, size)
+			return !found, err
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		// a complete entry after the uncommitted batch means that the batch is not at the end.
+		if !entry.Batch {
+			return false, nil
+		}
+		offset = next
+	}
+}
+
+// validEntryAfter reports whether a valid entry starts anywhere between offset and size. The file
+// is read in large chunks, since an entry can start at any byte.
+func (dfs *DatafileScanner) validEntryAfter(offset, size int64) (bool, error) {
+	window := make([]byte, 1024*1024)
+	headerSize := dfs.headerSize
+
+	for start := offset + 1; start+int64(headerSize) <= size; {
+		nBytes, err := dfs.file.ReadAt(window, start)
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+
+		for i := 0; i+headerSize <= nBytes; i++ {
+			meta := window[i : i+headerSize]
+			_, _, ksize, vsize, _ := encoder.DecodeEntryMeta(meta)
+
+			length := int64(headerSize) + int64(ksize) + int64(vsize)
+			if start+int64(i)+length > size {
+				continue
+			}
+
+			// the entry is checked from the window when it fits, so zeroed space is fast to skip.
+			if int64(i)+length <= int64(nBytes) {
+				key := window[i+headerSize : i+headerSize+int(ksize)]
+				if encoder.VerifyEntry(meta, key, window[i+headerSize+int(ksize):i+int(length)]) {
+					return true, nil
+				}
+				continue
+			}
+
+			if _, _, err := dfs.readEntry(start + int64(i)); err == nil {
+				return true, nil
+			}
+		}
+
+		if nBytes < len(window) {
+			break
+		}
+		// the next window overlaps such that the headers on the border are not missed.
+		start += int64(nBytes - headerSize + 1)
+	}
+
+	return false, nil
+}
+
 // InitDataFileScanner creates a new scanner that can read entries in a datafile one by one.
 func InitDatafileScanner(df *Datafile) *DatafileScanner {
 	return &DatafileScanner{
 		amount: 0,
 		offset: 0,
 		file:   df.file,
+		cipher: df.cipher,
 	}
 }
@@ -2,11 +2,20 @@ package datafile_test
 
 import (
 	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/nireo/bitcask/datafile"
+	"github.com/nireo/bitcask/encoder"
+	"github.com/nireo/bitcask/encryption"
+	"github.com/nireo/bitcask/hint"
+	"github.com/nireo/bitcask/keydir"
 	"github.com/nireo/bitcask/utils"
 )
 
@@ -131,3 +140,360 @@ func TestDatafileScanner(t *testing.T) {
 		t.Errorf("the keys don't match")
 	}
 }
+
+func TestRecover(t *testing.T) {
+	createTestDirectory(t)
+
+	df, err := datafile.NewDatafile("./test")
+	if err != nil {
+		t.Fatalf("error creating datafile: %s", err)
+	}
+
+	if _, err := df.Write([]byte("hello"), []byte("world")); err != nil {
+		t.Fatalf("could not write entry")
+	}
+	size := df.Offset()
+
+	// write a part of an entry to simulate a crash in the middle of a write.
+	partial := encoder.EncodeEntry([]byte("world"), []byte("hello"), 0)
+	if _, err := df.Write([]byte("world"), []byte("hello")); err != nil {
+		t.Fatalf("could not write entry")
+	}
+	path := df.GetPath("./test")
+	df.Close()
+
+	if err := os.Truncate(path, size+int64(len(partial))-3); err != nil {
+		t.Fatalf("could not truncate datafile: %s", err)
+	}
+
+	dropped, newSize, err := datafile.Recover(path)
+	if err != nil {
+		t.Fatalf("error recovering datafile: %s", err)
+	}
+
+	if dropped != int64(len(partial))-3 {
+		t.Errorf("wrong amount of bytes dropped. got=%d want=%d", dropped, len(partial)-3)
+	}
+
+	if newSize != size {
+		t.Errorf("wrong size after recovery. got=%d want=%d", newSize, size)
+	}
+
+	readable, err := datafile.NewReadOnlyDatafile(path, nil)
+	if err != nil {
+		t.Fatalf("could not open datafile: %s", err)
+	}
+	defer readable.Close()
+
+	scanner := datafile.InitDatafileScanner(readable)
+	if _, err := scanner.Scan(); err != nil {
+		t.Errorf("could not scan the valid entry: %s", err)
+	}
+
+	if _, err := scanner.Scan(); err != io.EOF {
+		t.Errorf("expected the end of the datafile. got=%v", err)
+	}
+}
+
+func TestRecoverCorruptEntry(t *testing.T) {
+	createTestDirectory(t)
+
+	df, err := datafile.NewDatafile("./test")
+	if err != nil {
+		t.Fatalf("error creating datafile: %s", err)
+	}
+
+	var offsets []int64
+	for _, key := range []string{"first", "second", "third"} {
+		mementry, err := df.Write([]byte(key), []byte("value"))
+		if err != nil {
+			t.Fatalf("could not write entry: %s", err)
+		}
+		offsets = append(offsets, mementry.ValOffset)
+	}
+	path := df.GetPath("./test")
+	size := df.Offset()
+	df.Close()
+
+	f, err := os.OpenFile(path, os.O_WRONLY, 0777)
+	if err != nil {
+		t.Fatalf("could not open datafile: %s", err)
+	}
+	defer f.Close()
+
+	// a corrupt entry in the middle of the datafile is not a torn write.
+	if _, err := f.WriteAt([]byte("V"), offsets[1]); err != nil {
+		t.Fatalf("could not write to datafile: %s", err)
+	}
+
+	dropped, offset, err := datafile.Recover(path)
+	if err != datafile.ErrCorruptedEntry {
+		t.Fatalf("expected a corrupted entry error. got=%v", err)
+	}
+
+	if dropped != 0 || offset != offsets[0]+int64(len("value")) {
+		t.Errorf("wrong result. got=%d,%d want=0,%d", dropped, offset, offsets[0]+int64(len("value")))
+	}
+
+	if stat, _ := os.Stat(path); stat.Size() != size {
+		t.Errorf("the datafile was modified. got=%d want=%d", stat.Size(), size)
+	}
+
+	// the corrupt entry at the end of the datafile is dropped.
+	if _, err := f.WriteAt([]byte("value"), offsets[1]); err != nil {
+		t.Fatalf("could not write to datafile: %s", err)
+	}
+
+	if _, err := f.WriteAt([]byte("V"), offsets[2]); err != nil {
+		t.Fatalf("could not write to datafile: %s", err)
+	}
+
+	dropped, newSize, err := datafile.Recover(path)
+	if err != nil {
+		t.Fatalf("error recovering datafile: %s", err)
+	}
+
+	if want := offsets[1] + int64(len("value")); newSize != want || dropped != size-want {
+		t.Errorf("wrong result. got=%d,%d want=%d,%d", dropped, newSize, size-want, want)
+	}
+}
+
+func TestRecoverZeroedTail(t *testing.T) {
+	createTestDirectory(t)
+
+	df, err := datafile.NewDatafile("./test")
+	if err != nil {
+		t.Fatalf("error creating datafile: %s", err)
+	}
+
+	// the entries are written with a single write, like a group commit.
+	value := bytes.Repeat([]byte("v"), 8*1024)
+	mementries, err := df.AppendEntries([]*datafile.Entry{
+		{Key: []byte("first"), Value: value},
+		{Key: []byte("second"), Value: value},
+		{Key: []byte("third"), Value: value},
+	})
+	if err != nil {
+		t.Fatalf("could not write entries: %s", err)
+	}
+	path := df.GetPath("./test")
+	size := df.Offset()
+	df.Close()
+
+	// the header of the second entry reached the disk, but the rest of the write reads back as
+	// zeroes.
+	zeroed := mementries[1].ValOffset + 100
+	f, err := os.OpenFile(path, os.O_WRONLY, 0777)
+	if err != nil {
+		t.Fatalf("could not open datafile: %s", err)
+	}
+
+	if _, err := f.WriteAt(make([]byte, size-zeroed), zeroed); err != nil {
+		t.Fatalf("could not write to datafile: %s", err)
+	}
+	f.Close()
+
+	dropped, newSize, err := datafile.Recover(path)
+	if err != nil {
+		t.Fatalf("error recovering datafile: %s", err)
+	}
+
+	if want := mementries[0].ValOffset + int64(len(value)); newSize != want || dropped != size-want {
+		t.Errorf("wrong result. got=%d,%d want=%d,%d", dropped, newSize, size-want, want)
+	}
+}
+
+func TestSealedEntries(t *testing.T) {
+	createTestDirectory(t)
+
+	current, _ := encryption.New(bytes.Repeat([]byte{1}, 16))
+	other, _ := encryption.New(bytes.Repeat([]byte{2}, 16))
+
+	df, err := datafile.NewDatafileWithID("./test", 1, current)
+	if err != nil {
+		t.Fatalf("error creating datafile: %s", err)
+	}
+
+	// an entry sealed with another cipher is encrypted again with the cipher of the datafile.
+	entries := []*datafile.Entry{
+		{Key: []byte("current"), Value: []byte("value1")},
+		{Key: []byte("other"), Value: []byte("value2")},
+	}
+	if err := entries[0].Seal(current); err != nil {
+		t.Fatalf("could not seal entry: %s", err)
+	}
+
+	if err := entries[1].Seal(other); err != nil {
+		t.Fatalf("could not seal entry: %s", err)
+	}
+
+	if _, err := df.AppendEntries(entries); err != nil {
+		t.Fatalf("could not write entries: %s", err)
+	}
+	path := df.GetPath("./test")
+	df.Close()
+
+	keyring, _ := encryption.NewKeyring(current)
+	readable, err := datafile.NewReadOnlyDatafile(path, keyring)
+	if err != nil {
+		t.Fatalf("could not open datafile: %s", err)
+	}
+	defer readable.Close()
+
+	scanner := datafile.InitDatafileScanner(readable)
+	for _, want := range entries {
+		entry, err := scanner.Scan()
+		if err != nil {
+			t.Fatalf("could not scan entry: %s", err)
+		}
+
+		if !bytes.Equal(entry.Key, want.Key) || !bytes.Equal(entry.Value, want.Value) {
+			t.Errorf("wrong entry. got=%s:%s want=%s:%s", entry.Key, entry.Value, want.Key, want.Value)
+		}
+	}
+}
+
+func TestRebuildKeyDirInvalidEntry(t *testing.T) {
+	createTestDirectory(t)
+
+	df, err := datafile.NewDatafile("./test")
+	if err != nil {
+		t.Fatalf("error creating datafile: %s", err)
+	}
+
+	var offsets []int64
+	for _, key := range []string{"first", "second", "third"} {
+		mementry, err := df.Write([]byte(key), []byte("value"))
+		if err != nil {
+			t.Fatalf("could not write entry: %s", err)
+		}
+		offsets = append(offsets, mementry.ValOffset)
+	}
+	path := df.GetPath("./test")
+	id := df.ID()
+	df.Close()
+
+	if err := os.Remove(hint.Path("./test", id)); err != nil {
+		t.Fatalf("could not remove hint file: %s", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY, 0777)
+	if err != nil {
+		t.Fatalf("could not open datafile: %s", err)
+	}
+
+	if _, err := f.WriteAt([]byte("V"), offsets[1]); err != nil {
+		t.Fatalf("could not write to datafile: %s", err)
+	}
+	f.Close()
+
+	readable, err := datafile.NewReadOnlyDatafile(path, nil)
+	if err != nil {
+		t.Fatalf("could not open datafile: %s", err)
+	}
+	defer readable.Close()
+
+	kd := keydir.NewKeyDir()
+	if err := datafile.RebuildKeyDir(readable, "./test", kd); err != encoder.ErrChecksumMismatch {
+		t.Fatalf("expected a checksum mismatch. got=%v", err)
+	}
+
+	if kd.Get("first") == nil {
+		t.Errorf("the entry before the invalid entry was not added")
+	}
+
+	// the hint file would hide the entries after the invalid entry on the next startup.
+	files, _ := filepath.Glob("./test/*.hnt*")
+	if len(files) != 0 {
+		t.Errorf("a hint file was written for a datafile with an invalid entry: %v", files)
+	}
+}
+
+func TestScanBatch(t *testing.T) {
+	createTestDirectory(t)
+
+	df, err := datafile.NewDatafile("./test")
+	if err != nil {
+		t.Fatalf("error creating datafile: %s", err)
+	}
+	defer df.Close()
+
+	batch := []*datafile.Entry{
+		{Key: []byte("hello"), Value: []byte("world"), Batch: true},
+		{Key: []byte("world"), Value: []byte("hello"), Batch: true},
+		datafile.CommitEntry(2, 0),
+	}
+	if _, err := df.AppendEntries(batch); err != nil {
+		t.Fatalf("could not write batch: %s", err)
+	}
+	committed := df.Offset()
+
+	// a batch without a commit entry.
+	if _, err := df.AppendEntries(batch[:2]); err != nil {
+		t.Fatalf("could not write batch: %s", err)
+	}
+
+	scanner := datafile.InitDatafileScanner(df)
+	for _, want := range []string{"hello", "world"} {
+		entry, err := scanner.Scan()
+		if err != nil {
+			t.Fatalf("error scanning batch entry: %s", err)
+		}
+
+		if string(entry.Key) != want || entry.Batch || entry.Commit {
+			t.Errorf("wrong entry. got=%s batch=%v commit=%v", entry.Key, entry.Batch, entry.Commit)
+		}
+	}
+
+	if _, err := scanner.Scan(); err != datafile.ErrIncompleteBatch {
+		t.Errorf("expected an incomplete batch. got=%v", err)
+	}
+
+	if scanner.Offset() != committed {
+		t.Errorf("the scanner moved past the incomplete batch. got=%d want=%d", scanner.Offset(), committed)
+	}
+}
+
+func TestReadVersion2(t *testing.T) {
+	createTestDirectory(t)
+
+	// version 2 entry headers don't contain the expiry time.
+	header := encoder.EncodeFileHeader(encoder.DatafileMagic, 1, 0)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+
+	entry := make([]byte, encoder.EntryHeaderSizeFor(2))
+	binary.LittleEndian.PutUint32(entry[4:8], 10)
+	binary.LittleEndian.PutUint32(entry[8:12], 5)
+	binary.LittleEndian.PutUint32(entry[12:16], 5)
+	entry = append(entry, []byte("helloworld")...)
+	binary.LittleEndian.PutUint32(entry[0:4], crc32.ChecksumIEEE(entry[4:]))
+
+	path := datafile.Path("./test", 1)
+	if err := ioutil.WriteFile(path, append(header, entry...), 0666); err != nil {
+		t.Fatalf("could not write datafile: %s", err)
+	}
+
+	df, err := datafile.NewReadOnlyDatafile(path, nil)
+	if err != nil {
+		t.Fatalf("could not open datafile: %s", err)
+	}
+	defer df.Close()
+
+	scanned, err := datafile.InitDatafileScanner(df).Scan()
+	if err != nil {
+		t.Fatalf("could not scan entry: %s", err)
+	}
+
+	if string(scanned.Key) != "hello" || string(scanned.Value) != "world" || scanned.Expiry != 0 {
+		t.Errorf("wrong entry. got=%+v", scanned)
+	}
+
+	value, err := df.ReadEntry([]byte("hello"), scanned.ValOffset, scanned.ValueSize)
+	if err != nil {
+		t.Fatalf("could not read entry: %s", err)
+	}
+
+	if string(value) != "world" {
+		t.Errorf("wrong value. got=%s want=world", string(value))
+	}
+}
@@ -0,0 +1,128 @@
+package datafile
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	ErrAlreadyMapped = errors.New("the datafile is already memory-mapped")
+)
+
+// mapping is a read-only memory mapping of a datafile. The mapping is only released once the
+// datafile has been closed and all of the views into it have been released, so a merge can close
+// a datafile while its values are still being used.
+type mapping struct {
+	mu     sync.Mutex
+	data   []byte
+	refs   int
+	closed bool
+}
+
+// acquire makes sure that the mapping stays valid until release is called. It returns false if
+// the mapping has already been closed.
+func (m *mapping) acquire() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return false
+	}
+	m.refs++
+
+	return true
+}
+
+func (m *mapping) release() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.refs--
+	if m.refs == 0 && m.closed {
+		munmap(m.data)
+		m.data = nil
+	}
+}
+
+func (m *mapping) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return
+	}
+	m.closed = true
+
+	if m.refs == 0 {
+		munmap(m.data)
+		m.data = nil
+	}
+}
+
+// slice returns the bytes in [offset, offset+size) from the mapping. The caller needs to have
+// acquired the mapping.
+func (m *mapping) slice(offset int64, size uint32) ([]byte, error) {
+	if offset < 0 || offset+int64(size) > int64(len(m.data)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return m.data[offset : offset+int64(size)], nil
+}
+
+// Mmap maps a read-only datafile into memory. After this ReadOffset copies the values from the
+// mapping instead of reading the file, and View can return values without copying them. The
+// writable datafile should not be mapped, since the mapping doesn't grow with the file.
+func (df *Datafile) Mmap() error {
+	if df.mapping != nil {
+		return ErrAlreadyMapped
+	}
+
+	stat, err := df.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	data, err := mmapFile(df.file, int(stat.Size()))
+	if err != nil {
+		return err
+	}
+	df.mapping = &mapping{data: data}
+
+	return nil
+}
+
+// View returns size bytes starting from offset. If the datafile is memory-mapped the bytes are not
+// copied, and they stay valid until the returned release function is called. The bytes must not
+// be modified.
+func (df *Datafile) View(offset int64, size uint32) ([]byte, func(), error) {
+	if df.mapping == nil || !df.mapping.acquire() {
+		data, err := df.ReadOffset(offset, size)
+		return data, func() {}, err
+	}
+
+	data, err := df.mapping.slice(offset, size)
+	if err != nil {
+		df.mapping.release()
+		return nil, nil, err
+	}
+
+	return data, df.mapping.release, nil
+}
+
+// ViewEntry works like ReadEntry, but the value is returned without copying it if the datafile is
+// memory-mapped. The value stays valid until the returned release function is called.
+func (df *Datafile) ViewEntry(key []byte, valOffset int64, valueSize uint32) ([]byte, func(), error) {
+	data, release, err := df.View(df.EntryOffset(key, valOffset), uint32(df.headerSize+df.storedKeySize(key))+valueSize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	value, err := df.checkEntry(data, key, valueSize)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+
+	return value, release, nil
+}
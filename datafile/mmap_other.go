@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package datafile
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapFile is not supported on this platform, so the datafiles are read with pread.
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return nil, errors.New("mmap is not supported on this platform")
+}
+
+func munmap(data []byte) error {
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package datafile
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the whole file into memory as read-only.
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// munmap releases a mapping created by mmapFile.
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -1,21 +1,188 @@
 package encoder
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash/crc32"
 )
 
+const (
+	// EntryHeaderSize is the size of the metadata in front of each entry in a datafile. It contains
+	// the crc, timestamp, keysize, value size, the flags and the expiry time.
+	EntryHeaderSize = 21
+
+	// HintHeaderSize is the size of the metadata in front of each entry in a hint file. It contains
+	// the timestamp, keysize, value size, value offset, the flags and the expiry time.
+	HintHeaderSize = 25
+
+	// expirySize is the size of the expiry time at the end of the headers. Files older than
+	// version 3 don't have it.
+	expirySize = 4
+)
+
+const (
+	// FileHeaderSize is the size of the header at the start of each datafile and hint file. It
+	// contains the magic bytes, format version, encryption key id, file id and the creation time.
+	FileHeaderSize = 16
+
+	// FormatVersion is the version of the on-disk format. It needs to be bumped whenever the entry
+	// or hint encoding changes.
+	FormatVersion uint16 = 5
+
+	// MinFormatVersion is the oldest format version that can still be read. Version 1 files don't
+	// contain batches, the headers of version 1 and 2 files don't contain the expiry time, values
+	// are compressed only since version 4 and files are encrypted only since version 5, but
+	// otherwise they are the same.
+	MinFormatVersion uint16 = 1
+
+	// expiryVersion is the first format version that stores expiry times.
+	expiryVersion uint16 = 3
+)
+
+var (
+	// DatafileMagic is at the start of each datafile.
+	DatafileMagic = []byte("BCDF")
+
+	// HintMagic is at the start of each hint file.
+	HintMagic = []byte("BCHT")
+)
+
+const (
+	// FlagTombstone marks an entry that deletes a key. Tombstones don't have a value.
+	FlagTombstone byte = 1 << iota
+
+	// FlagBatch marks an entry that was written as a part of a batch. The entries of a batch are
+	// only valid if they are followed by a commit entry.
+	FlagBatch
+
+	// FlagBatchCommit marks the entry that commits a batch. It doesn't have a key and its value
+	// contains the amount of entries in the batch.
+	FlagBatchCommit
+)
+
+const (
+	// codecShift is the position of the compression codec in the flags. The codec takes the three
+	// bits above the other flags, and zero means that the value is not compressed.
+	codecShift      = 3
+	codecMask  byte = 7 << codecShift
+)
+
+// CodecFlags returns the flags that mark a value as compressed with the given codec.
+func CodecFlags(codec byte) byte {
+	return codec << codecShift & codecMask
+}
+
+// DecodeCodec returns the compression codec stored in the flags of an entry.
+func DecodeCodec(flags byte) byte {
+	return flags & codecMask >> codecShift
+}
+
+var (
+	ErrChecksumMismatch   = errors.New("the crc32 checksum doesn't match")
+	ErrInvalidMagic       = errors.New("the file doesn't start with the expected magic bytes")
+	ErrUnsupportedVersion = errors.New("the file format version is not supported")
+	ErrShortHeader        = errors.New("the file is too short to contain a header")
+)
+
+// EncodeFileHeader creates the header that is written at the start of a datafile or hint file.
+func EncodeFileHeader(magic []byte, id, created uint32) []byte {
+	return EncodeFileHeaderWithKey(magic, id, created, 0)
+}
+
+// EncodeFileHeaderWithKey works like EncodeFileHeader, but it also stores the id of the key the
+// file is encrypted with. Zero means that the file is not encrypted.
+func EncodeFileHeaderWithKey(magic []byte, id, created uint32, keyID uint16) []byte {
+	buffer := make([]byte, FileHeaderSize)
+	copy(buffer[0:4], magic)
+	binary.LittleEndian.PutUint16(buffer[4:6], FormatVersion)
+	binary.LittleEndian.PutUint16(buffer[6:8], keyID)
+	binary.LittleEndian.PutUint32(buffer[8:12], id)
+	binary.LittleEndian.PutUint32(buffer[12:16], created)
+
+	return buffer
+}
+
+// DecodeFileHeader checks that the header has the right magic bytes and a supported format version.
+// It returns the file id and the creation time stored in the header.
+func DecodeFileHeader(data []byte, magic []byte) (uint32, uint32, error) {
+	id, created, _, err := DecodeFileHeaderVersion(data, magic)
+	return id, created, err
+}
+
+// DecodeFileHeaderVersion works like DecodeFileHeader, but it also returns the format version of
+// the file.
+func DecodeFileHeaderVersion(data []byte, magic []byte) (uint32, uint32, uint16, error) {
+	if len(data) < FileHeaderSize {
+		return 0, 0, 0, ErrShortHeader
+	}
+
+	if !bytes.Equal(data[0:4], magic) {
+		return 0, 0, 0, fmt.Errorf("%w: got=%q want=%q", ErrInvalidMagic, data[0:4], magic)
+	}
+
+	version := binary.LittleEndian.Uint16(data[4:6])
+	if version < MinFormatVersion || version > FormatVersion {
+		return 0, 0, 0, fmt.Errorf("%w: got=%d want=%d", ErrUnsupportedVersion, version, FormatVersion)
+	}
+
+	id := binary.LittleEndian.Uint32(data[8:12])
+	created := binary.LittleEndian.Uint32(data[12:16])
+
+	return id, created, version, nil
+}
+
+// DecodeFileKeyID returns the id of the encryption key stored in a file header that has already been
+// checked with DecodeFileHeader. The bytes were reserved before version 5, so they are always zero
+// in the older files.
+func DecodeFileKeyID(data []byte) uint16 {
+	return binary.LittleEndian.Uint16(data[6:8])
+}
+
+// EntryHeaderSizeFor returns the size of the entry headers in a datafile with the given format
+// version.
+func EntryHeaderSizeFor(version uint16) int {
+	if version < expiryVersion {
+		return EntryHeaderSize - expirySize
+	}
+
+	return EntryHeaderSize
+}
+
+// HintHeaderSizeFor returns the size of the entry headers in a hint file with the given format
+// version.
+func HintHeaderSizeFor(version uint16) int {
+	if version < expiryVersion {
+		return HintHeaderSize - expirySize
+	}
+
+	return HintHeaderSize
+}
+
 // EncodeEntry takes in a key, value and timestamp and then creates a buffer containing
 // all of the data from that. This data is appended to a datafile.
 func EncodeEntry(key []byte, value []byte, ts uint32) []byte {
-	// the header contains the first 16 bytes denoting the crc, timestamp, keysize
-	// value size and then followed by the lengths of key, and value.
+	return EncodeEntryWithFlags(key, value, ts, 0)
+}
+
+// EncodeEntryWithFlags works like EncodeEntry, but it also stores the given flags in the header.
+func EncodeEntryWithFlags(key []byte, value []byte, ts uint32, flags byte) []byte {
+	return EncodeEntryWithExpiry(key, value, ts, 0, flags)
+}
 
-	buffer := make([]byte, 16)
+// EncodeEntryWithExpiry works like EncodeEntryWithFlags, but it also stores the unix time after
+// which the entry has expired. Zero means that the entry never expires.
+func EncodeEntryWithExpiry(key []byte, value []byte, ts, expiry uint32, flags byte) []byte {
+	// the header contains the first 21 bytes denoting the crc, timestamp, keysize
+	// value size, flags and expiry and then followed by the key, and value.
+
+	buffer := make([]byte, EntryHeaderSize)
 	binary.LittleEndian.PutUint32(buffer[4:8], ts)
 	binary.LittleEndian.PutUint32(buffer[8:12], uint32(len(key)))
 	binary.LittleEndian.PutUint32(buffer[12:16], uint32(len(value)))
+	buffer[16] = flags
+	binary.LittleEndian.PutUint32(buffer[17:21], expiry)
 
 	buffer = append(buffer[:], key[:]...)
 	buffer = append(buffer[:], value[:]...)
@@ -26,77 +193,122 @@ func EncodeEntry(key []byte, value []byte, ts uint32) []byte {
 	return buffer
 }
 
-// DecodeEntryMeta decodes a byte buffer of length 16 and then returns the metadata information
-// about the given entry.
-func DecodeEntryMeta(data []byte) (uint32, uint32, uint32, uint32) {
-	crc := binary.LittleEndian.Uint32(data[4:8])
+// DecodeEntryMeta decodes the entry header at the start of a buffer and then returns the metadata
+// information about the given entry. The buffer needs to be at least 17 bytes long, which is the
+// header size of the older format versions.
+func DecodeEntryMeta(data []byte) (uint32, uint32, uint32, uint32, byte) {
+	crc := binary.LittleEndian.Uint32(data[0:4])
 	timestamp := binary.LittleEndian.Uint32(data[4:8])
 	ksize := binary.LittleEndian.Uint32(data[8:12])
 	vsize := binary.LittleEndian.Uint32(data[12:16])
 
-	return crc, timestamp, ksize, vsize
+	return crc, timestamp, ksize, vsize, data[16]
 }
 
-// DecodeEntryValue takes in some data and decodes the value from the data.
-func DecodeEntryValue(data []byte) ([]byte, error) {
-	ksize := binary.LittleEndian.Uint32(data[8:12])
-	vsize := binary.LittleEndian.Uint32(data[12:20])
+// DecodeEntryExpiry returns the expiry time stored in an entry header. Headers of the older format
+// versions don't contain it, so zero is returned for them.
+func DecodeEntryExpiry(meta []byte) uint32 {
+	if len(meta) < EntryHeaderSize {
+		return 0
+	}
 
-	value := make([]byte, vsize)
+	return binary.LittleEndian.Uint32(meta[17:21])
+}
 
-	// copy the value from the buffer
-	copy(value, data[(16+ksize):(16+ksize+vsize)])
+// VerifyEntry checks that the crc32 checksum stored in the metadata matches the rest
+// of the metadata, the key and the value. The metadata needs to contain the whole header.
+func VerifyEntry(meta, key, value []byte) bool {
+	crc := crc32.ChecksumIEEE(meta[4:])
+	crc = crc32.Update(crc, crc32.IEEETable, key)
+	crc = crc32.Update(crc, crc32.IEEETable, value)
 
-	c32 := binary.LittleEndian.Uint32(data[:4])
-	if crc32.ChecksumIEEE(data[4:]) != c32 {
-		return nil, errors.New("the crc32 checksum doesn't match")
-	}
+	return crc == binary.LittleEndian.Uint32(meta[:4])
+}
 
-	return value, nil
+// DecodeEntryValue takes in some data and decodes the value from the data.
+func DecodeEntryValue(data []byte) ([]byte, error) {
+	_, _, _, value, err := decodeEntry(data)
+	return value, err
 }
 
-// DecodeHintMeta takes in a buffer of length 20 and parses hint metadata from it.
-// It also expects the buffer to be 20 bytes long otherwise a panic will happen.
-func DecodeHintMeta(metaBuffer []byte) (uint32, uint32, uint32, int64) {
+// DecodeHintMeta takes in a hint header and parses hint metadata from it. The buffer needs to be
+// at least 21 bytes long otherwise a panic will happen.
+func DecodeHintMeta(metaBuffer []byte) (uint32, uint32, uint32, int64, byte) {
 	timestamp := binary.LittleEndian.Uint32(metaBuffer[:4])
 	ksize := binary.LittleEndian.Uint32(metaBuffer[4:8])
 	vsize := binary.LittleEndian.Uint32(metaBuffer[8:12])
 	offset := binary.LittleEndian.Uint64(metaBuffer[12:20])
 
-	return timestamp, ksize, vsize, int64(offset)
+	return timestamp, ksize, vsize, int64(offset), metaBuffer[20]
+}
+
+// DecodeHintExpiry returns the expiry time stored in a hint header or zero if the header is from
+// an older format version.
+func DecodeHintExpiry(metaBuffer []byte) uint32 {
+	if len(metaBuffer) < HintHeaderSize {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint32(metaBuffer[21:25])
 }
 
 // DecodeAll returns all of the information and returns all of the variables.
 func DecodeAll(data []byte) (uint32, uint32, uint32, []byte, []byte, error) {
-	if len(data) < 20 {
-		return 0, 0, 0, nil, nil, errors.New("too few bytes to properly read")
+	timestamp, _, key, value, err := decodeEntry(data)
+	if err != nil {
+		return 0, 0, 0, nil, nil, err
 	}
 
-	timestamp := binary.LittleEndian.Uint32(data[4:8])
-	ksize := binary.LittleEndian.Uint32(data[8:12])
-	vsize := binary.LittleEndian.Uint32(data[12:16])
+	return timestamp, uint32(len(key)), uint32(len(value)), key, value, nil
+}
+
+// decodeEntry decodes a whole entry and checks its checksum.
+func decodeEntry(data []byte) (uint32, byte, []byte, []byte, error) {
+	if len(data) < EntryHeaderSize {
+		return 0, 0, nil, nil, errors.New("too few bytes to properly read")
+	}
+
+	_, timestamp, ksize, vsize, flags := DecodeEntryMeta(data)
+
+	// a corrupted header can contain sizes that don't fit in the buffer.
+	if EntryHeaderSize+uint64(ksize)+uint64(vsize) > uint64(len(data)) {
+		return 0, 0, nil, nil, ErrChecksumMismatch
+	}
 
 	key := make([]byte, ksize)
 	value := make([]byte, vsize)
-	copy(key, data[16:16+ksize])
-	copy(value, data[16+ksize:16+ksize+vsize])
+	copy(key, data[EntryHeaderSize:EntryHeaderSize+ksize])
+	copy(value, data[EntryHeaderSize+ksize:EntryHeaderSize+ksize+vsize])
 
 	crc := binary.LittleEndian.Uint32(data[0:4])
-	if crc32.ChecksumIEEE(data[4:]) != crc {
-		return 0, 0, 0, nil, nil, errors.New("the crc32 checksum doesn't match")
+	if crc32.ChecksumIEEE(data[4:EntryHeaderSize+ksize+vsize]) != crc {
+		return 0, 0, nil, nil, ErrChecksumMismatch
 	}
 
-	return timestamp, ksize, vsize, key, value, nil
+	return timestamp, flags, key, value, nil
 }
 
 // EncodeHint takes in all of the data contained in hints and returns a byte buffer
 // that contains all of it.
 func EncodeHint(timestamp, vsize uint32, offset int64, key []byte) []byte {
-	buffer := make([]byte, 20)
+	return EncodeHintWithFlags(timestamp, vsize, offset, key, 0)
+}
+
+// EncodeHintWithFlags works like EncodeHint, but it also stores the given flags in the hint.
+func EncodeHintWithFlags(timestamp, vsize uint32, offset int64, key []byte, flags byte) []byte {
+	return EncodeHintWithExpiry(timestamp, vsize, offset, key, 0, flags)
+}
+
+// EncodeHintWithExpiry works like EncodeHintWithFlags, but it also stores the expiry time of the
+// entry in the hint.
+func EncodeHintWithExpiry(timestamp, vsize uint32, offset int64, key []byte, expiry uint32, flags byte) []byte {
+	buffer := make([]byte, HintHeaderSize)
 	binary.LittleEndian.PutUint32(buffer[0:4], timestamp)
 	binary.LittleEndian.PutUint32(buffer[4:8], uint32(len(key)))
 	binary.LittleEndian.PutUint32(buffer[8:12], vsize)
 	binary.LittleEndian.PutUint64(buffer[12:20], uint64(offset))
+	buffer[20] = flags
+	binary.LittleEndian.PutUint32(buffer[21:25], expiry)
 	buffer = append(buffer[:], key[:]...)
 
 	return buffer
@@ -105,16 +317,30 @@ func EncodeHint(timestamp, vsize uint32, offset int64, key []byte) []byte {
 // DecodeHint returns all of information stored in a mementry and lastly it also returns
 // the amount of bytes read. Such that the scanning through the values works better.
 func DecodeHint(buffer []byte) (uint32, uint32, int64, []byte, uint32) {
-	if len(buffer) < 20 {
+	if len(buffer) < HintHeaderSize {
 		return 0, 0, 0, nil, 0
 	}
 
-	timestamp := binary.LittleEndian.Uint32(buffer[:4])
-	vsize := binary.LittleEndian.Uint32(buffer[8:12])
-	offset := binary.LittleEndian.Uint64(buffer[12:20])
+	timestamp, ksize, vsize, offset, _ := DecodeHintMeta(buffer)
+	key := buffer[HintHeaderSize : ksize+HintHeaderSize]
+
+	return timestamp, vsize, offset, key, HintHeaderSize + ksize
+}
 
-	ksize := binary.LittleEndian.Uint32(buffer[4:8])
-	key := buffer[20 : ksize+20]
+// EncodeBatchCount encodes the amount of entries in a batch into the value of a commit entry.
+func EncodeBatchCount(count uint32) []byte {
+	buffer := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buffer, count)
+
+	return buffer
+}
+
+// DecodeBatchCount decodes the amount of entries in a batch from the value of a commit entry. The
+// bool is false if the value isn't a valid batch count.
+func DecodeBatchCount(value []byte) (uint32, bool) {
+	if len(value) != 4 {
+		return 0, false
+	}
 
-	return timestamp, vsize, int64(offset), key, 20 + ksize
+	return binary.LittleEndian.Uint32(value), true
 }
@@ -2,6 +2,7 @@ package encoder_test
 
 import (
 	"bytes"
+	"errors"
 	"testing"
 	"time"
 
@@ -26,3 +27,84 @@ func TestEntryEncodeDecode(t *testing.T) {
 		t.Errorf("the values don't match. got=%s want=%s", string(value), []byte("world"))
 	}
 }
+
+func TestEntryFlags(t *testing.T) {
+	ts := uint32(time.Now().Unix())
+	data := encoder.EncodeEntryWithFlags([]byte("hello"), nil, ts, encoder.FlagTombstone)
+
+	_, _, ksize, vsize, flags := encoder.DecodeEntryMeta(data)
+	if flags&encoder.FlagTombstone == 0 {
+		t.Errorf("the tombstone flag was not set")
+	}
+
+	if ksize != 5 || vsize != 0 {
+		t.Errorf("wrong sizes. got=%d,%d want=5,0", ksize, vsize)
+	}
+
+	if !encoder.VerifyEntry(data[:encoder.EntryHeaderSize], []byte("hello"), nil) {
+		t.Errorf("the checksum doesn't match")
+	}
+}
+
+func TestFileHeader(t *testing.T) {
+	header := encoder.EncodeFileHeader(encoder.DatafileMagic, 10, 20)
+
+	id, created, err := encoder.DecodeFileHeader(header, encoder.DatafileMagic)
+	if err != nil {
+		t.Fatalf("could not decode header: %s", err)
+	}
+
+	if id != 10 || created != 20 {
+		t.Errorf("wrong header values. got=%d,%d want=10,20", id, created)
+	}
+
+	if _, _, err := encoder.DecodeFileHeader(header, encoder.HintMagic); !errors.Is(err, encoder.ErrInvalidMagic) {
+		t.Errorf("expected an invalid magic error. got=%v", err)
+	}
+
+	// bump the version
+	header[4]++
+	if _, _, err := encoder.DecodeFileHeader(header, encoder.DatafileMagic); !errors.Is(err, encoder.ErrUnsupportedVersion) {
+		t.Errorf("expected an unsupported version error. got=%v", err)
+	}
+}
+
+func TestEntryExpiry(t *testing.T) {
+	ts := uint32(time.Now().Unix())
+	data := encoder.EncodeEntryWithExpiry([]byte("hello"), []byte("world"), ts, ts+10, 0)
+
+	meta := data[:encoder.EntryHeaderSize]
+	if expiry := encoder.DecodeEntryExpiry(meta); expiry != ts+10 {
+		t.Errorf("wrong expiry. got=%d want=%d", expiry, ts+10)
+	}
+
+	if !encoder.VerifyEntry(meta, []byte("hello"), []byte("world")) {
+		t.Errorf("the checksum doesn't match")
+	}
+
+	hint := encoder.EncodeHintWithExpiry(ts, 5, 100, []byte("hello"), ts+10, 0)
+	if expiry := encoder.DecodeHintExpiry(hint[:encoder.HintHeaderSize]); expiry != ts+10 {
+		t.Errorf("wrong hint expiry. got=%d want=%d", expiry, ts+10)
+	}
+
+	// the headers of the older versions don't contain the expiry.
+	if size := encoder.EntryHeaderSizeFor(2); size != 17 {
+		t.Errorf("wrong version 2 header size. got=%d want=17", size)
+	}
+
+	if expiry := encoder.DecodeEntryExpiry(meta[:encoder.EntryHeaderSizeFor(2)]); expiry != 0 {
+		t.Errorf("a version 2 header had an expiry. got=%d", expiry)
+	}
+}
+
+func TestCodecFlags(t *testing.T) {
+	flags := encoder.FlagBatch | encoder.CodecFlags(5)
+
+	if codec := encoder.DecodeCodec(flags); codec != 5 {
+		t.Errorf("wrong codec. got=%d want=5", codec)
+	}
+
+	if flags&(encoder.FlagTombstone|encoder.FlagBatchCommit) != 0 || flags&encoder.FlagBatch == 0 {
+		t.Errorf("the codec changed the other flags. got=%08b", flags)
+	}
+}
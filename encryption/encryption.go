@@ -0,0 +1,140 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Overhead is the amount of bytes Seal adds to the data. It contains the nonce and the
+// authentication tag.
+const Overhead = nonceSize + tagSize
+
+const (
+	nonceSize = 12
+	tagSize   = 16
+)
+
+var (
+	ErrInvalidKeySize = errors.New("the encryption key needs to be 16, 24 or 32 bytes long")
+	ErrUnknownKey     = errors.New("the file is encrypted with a key that was not given")
+	ErrDuplicateKeyID = errors.New("two of the encryption keys have the same id")
+	ErrDecrypt        = errors.New("could not decrypt the data, the key is wrong or the data is corrupted")
+)
+
+// Cipher encrypts data with AES-GCM. Each call to Seal uses a new random nonce, which is stored in
+// front of the encrypted data.
+type Cipher struct {
+	aead cipher.AEAD
+	id   uint16
+}
+
+// New creates a cipher from a 16, 24 or 32 byte key, which selects AES-128, AES-192 or AES-256.
+func New(key []byte) (*Cipher, error) {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, ErrInvalidKeySize
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cipher{
+		aead: aead,
+		id:   keyID(key),
+	}, nil
+}
+
+// keyID derives an identifier for a key, which is stored in the header of the files encrypted
+// with it. The id doesn't reveal the key, but it allows the right key to be picked when the files
+// are opened. Zero is used for files that are not encrypted, so it is never returned.
+func keyID(key []byte) uint16 {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("bitcask key id"))
+
+	id := binary.LittleEndian.Uint16(mac.Sum(nil))
+	if id == 0 {
+		id = 1
+	}
+
+	return id
+}
+
+// ID returns the identifier of the key of the cipher. It is never zero.
+func (c *Cipher) ID() uint16 {
+	return c.id
+}
+
+// Seal encrypts and authenticates the plaintext and authenticates the additional data. The
+// returned buffer contains the nonce followed by the encrypted data.
+func (c *Cipher) Seal(plaintext, additional []byte) ([]byte, error) {
+	buffer := make([]byte, nonceSize, nonceSize+len(plaintext)+tagSize)
+	if _, err := rand.Read(buffer); err != nil {
+		return nil, err
+	}
+
+	return c.aead.Seal(buffer, buffer, plaintext, additional), nil
+}
+
+// Open decrypts data created by Seal. The additional data needs to be the same as when the data
+// was sealed. ErrDecrypt is returned if the data can't be authenticated.
+func (c *Cipher) Open(data, additional []byte) ([]byte, error) {
+	if len(data) < Overhead {
+		return nil, ErrDecrypt
+	}
+
+	plaintext, err := c.aead.Open(nil, data[:nonceSize], data[nonceSize:], additional)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	return plaintext, nil
+}
+
+// Keyring contains the ciphers of all of the keys the files can be encrypted with.
+type Keyring map[uint16]*Cipher
+
+// NewKeyring creates a keyring from the given ciphers. Nil ciphers are skipped.
+func NewKeyring(ciphers ...*Cipher) (Keyring, error) {
+	keys := make(Keyring)
+	for _, c := range ciphers {
+		if c == nil {
+			continue
+		}
+
+		if _, ok := keys[c.ID()]; ok {
+			return nil, ErrDuplicateKeyID
+		}
+		keys[c.ID()] = c
+	}
+
+	return keys, nil
+}
+
+// Get returns the cipher for the key with the given id. Files that are not encrypted have the id
+// zero, and for them a nil cipher is returned.
+func (k Keyring) Get(id uint16) (*Cipher, error) {
+	if id == 0 {
+		return nil, nil
+	}
+
+	c, ok := k[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: key id %d", ErrUnknownKey, id)
+	}
+
+	return c, nil
+}
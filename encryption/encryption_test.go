@@ -0,0 +1,78 @@
+package encryption_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/nireo/bitcask/encryption"
+)
+
+func TestSealOpen(t *testing.T) {
+	c, err := encryption.New(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatalf("could not create cipher: %s", err)
+	}
+
+	sealed, err := c.Seal([]byte("value"), []byte("key"))
+	if err != nil {
+		t.Fatalf("could not seal data: %s", err)
+	}
+
+	if len(sealed) != len("value")+encryption.Overhead || bytes.Contains(sealed, []byte("value")) {
+		t.Errorf("the data was not encrypted. got=%x", sealed)
+	}
+
+	// each call uses a new nonce.
+	if again, _ := c.Seal([]byte("value"), []byte("key")); bytes.Equal(again, sealed) {
+		t.Errorf("sealing the same data twice gave the same result")
+	}
+
+	opened, err := c.Open(sealed, []byte("key"))
+	if err != nil {
+		t.Fatalf("could not open data: %s", err)
+	}
+
+	if string(opened) != "value" {
+		t.Errorf("wrong plaintext. got=%s want=value", string(opened))
+	}
+
+	if _, err := c.Open(sealed, []byte("other")); err != encryption.ErrDecrypt {
+		t.Errorf("opened data with the wrong additional data. err=%v", err)
+	}
+
+	sealed[len(sealed)-1] ^= 1
+	if _, err := c.Open(sealed, []byte("key")); err != encryption.ErrDecrypt {
+		t.Errorf("opened modified data. err=%v", err)
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	if _, err := encryption.New([]byte("short")); err != encryption.ErrInvalidKeySize {
+		t.Errorf("expected an invalid key size error. got=%v", err)
+	}
+
+	first, _ := encryption.New(bytes.Repeat([]byte{1}, 16))
+	second, _ := encryption.New(bytes.Repeat([]byte{2}, 16))
+
+	if first.ID() == 0 || first.ID() == second.ID() {
+		t.Errorf("wrong key ids. got=%d,%d", first.ID(), second.ID())
+	}
+
+	keyring, err := encryption.NewKeyring(first, nil)
+	if err != nil {
+		t.Fatalf("could not create keyring: %s", err)
+	}
+
+	if c, err := keyring.Get(first.ID()); c != first || err != nil {
+		t.Errorf("wrong cipher for the key. err=%v", err)
+	}
+
+	if c, err := keyring.Get(0); c != nil || err != nil {
+		t.Errorf("unencrypted files should not have a cipher. err=%v", err)
+	}
+
+	if _, err := keyring.Get(second.ID()); !errors.Is(err, encryption.ErrUnknownKey) {
+		t.Errorf("expected an unknown key error. got=%v", err)
+	}
+}
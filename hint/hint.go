@@ -3,10 +3,13 @@ package hint
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/nireo/bitcask/encoder"
+	"github.com/nireo/bitcask/encryption"
 	"github.com/nireo/bitcask/keydir"
 )
 
@@ -20,8 +23,9 @@ type HintFile struct {
 }
 
 type HintScanner struct {
-	offset int64
-	file   *os.File
+	offset     int64
+	file       *os.File
+	headerSize int
 }
 
 // Close closes the file pointer
@@ -29,9 +33,29 @@ func (hf *HintFile) Close() {
 	hf.File.Close()
 }
 
+// Sync flushes the hint file to the disk.
+func (hf *HintFile) Sync() error {
+	return hf.File.Sync()
+}
+
 // Append compiles data for a hint entry and appends to the end of the file pointer
 func (hf *HintFile) Append(timestamp, vsize uint32, offset int64, key []byte) error {
-	buffer := encoder.EncodeHint(timestamp, vsize, offset, key)
+	return hf.AppendWithFlags(timestamp, vsize, offset, key, 0)
+}
+
+// AppendTombstone appends a hint entry that marks the key as deleted. The offset points to the
+// end of the tombstone entry in the datafile.
+func (hf *HintFile) AppendTombstone(timestamp uint32, offset int64, key []byte) error {
+	return hf.AppendWithFlags(timestamp, 0, offset, key, encoder.FlagTombstone)
+}
+
+// AppendWithFlags appends a hint entry with the given entry flags.
+func (hf *HintFile) AppendWithFlags(timestamp, vsize uint32, offset int64, key []byte, flags byte) error {
+	return hf.AppendEncoded(encoder.EncodeHintWithFlags(timestamp, vsize, offset, key, flags))
+}
+
+// AppendEncoded appends hint entries that have already been encoded with the encoder.
+func (hf *HintFile) AppendEncoded(buffer []byte) error {
 	nBytes, err := hf.File.Write(buffer)
 	if err != nil {
 		return err
@@ -44,37 +68,125 @@ func (hf *HintFile) Append(timestamp, vsize uint32, offset int64, key []byte) er
 	return nil
 }
 
+// Scan reads the next entry from the hint file. It returns io.EOF when there are no more
+// entries and ErrWrongByteCount if the hint file ends in the middle of an entry. The scanner
+// doesn't move past an invalid entry.
 func (hfs *HintScanner) Scan() (*keydir.MemEntry, []byte, error) {
-	metaBuffer := make([]byte, 20, 20)
-	nBytes, err := hfs.file.ReadAt(metaBuffer, hfs.offset)
-	if err != nil {
-		return nil, nil, err
+	mementry, key, _, err := hfs.ScanWithFlags()
+	return mementry, key, err
+}
+
+// ScanWithFlags works like Scan, but it also returns the flags of the entry.
+func (hfs *HintScanner) ScanWithFlags() (*keydir.MemEntry, []byte, byte, error) {
+	// the file header is checked before reading the first entry.
+	if hfs.offset == 0 {
+		version, _, err := readHeader(hfs.file)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		hfs.offset = encoder.FileHeaderSize
+		hfs.headerSize = encoder.HintHeaderSizeFor(version)
+	}
+	offset := hfs.offset
+
+	metaBuffer := make([]byte, hfs.headerSize)
+	nBytes, err := hfs.file.ReadAt(metaBuffer, offset)
+	if err == io.EOF && nBytes == 0 {
+		return nil, nil, 0, io.EOF
+	}
+
+	if err != nil && err != io.EOF {
+		return nil, nil, 0, err
 	}
 
 	// we didn't read enough bytes
-	if nBytes != 20 {
-		return nil, nil, ErrWrongByteCount
+	if nBytes != hfs.headerSize {
+		return nil, nil, 0, ErrWrongByteCount
 	}
-	hfs.offset += int64(nBytes)
+	offset += int64(nBytes)
 
-	timestamp, ksize, vsize, offset := encoder.DecodeHintMeta(metaBuffer)
+	timestamp, ksize, vsize, valOffset, flags := encoder.DecodeHintMeta(metaBuffer)
 	key := make([]byte, ksize)
 
-	nBytes, err = hfs.file.ReadAt(key, hfs.offset)
-	if err != nil {
-		return nil, nil, err
+	nBytes, err = hfs.file.ReadAt(key, offset)
+	if err != nil && err != io.EOF {
+		return nil, nil, 0, err
 	}
 
 	if nBytes != int(ksize) {
-		return nil, nil, ErrWrongByteCount
+		return nil, nil, 0, ErrWrongByteCount
 	}
-	hfs.offset += int64(nBytes)
+	offset += int64(nBytes)
+	hfs.offset = offset
 
 	return &keydir.MemEntry{
 		Timestamp: timestamp,
-		ValOffset: offset,
+		ValOffset: valOffset,
 		ValSize:   vsize,
-	}, key, nil
+		Expiry:    encoder.DecodeHintExpiry(metaBuffer),
+		Codec:     encoder.DecodeCodec(flags),
+	}, key, flags, nil
+}
+
+// Offset returns the offset to the end of the last entry that was read.
+func (hfs *HintScanner) Offset() int64 {
+	return hfs.offset
+}
+
+// Recover truncates a hint file to the end of its last valid entry. Entries that point past the
+// end of the datafile are also dropped, since the datafile might have been truncated by recovery.
+// The amount of bytes dropped and the end of the last value in the datafile are returned. If the
+// end doesn't match the datafile size, the hint file is missing entries.
+func Recover(path string, datafileSize int64) (int64, int64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	end := int64(encoder.FileHeaderSize)
+	scanner := InitHintScanner(f)
+	for {
+		previous := scanner.Offset()
+		mementry, _, err := scanner.Scan()
+		if err == io.EOF {
+			return 0, end, nil
+		}
+
+		// the header is invalid, so the whole hint file needs to be rebuilt.
+		if previous == 0 && err != nil {
+			return 0, 0, nil
+		}
+
+		if err == ErrWrongByteCount {
+			break
+		}
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		valueEnd := mementry.ValOffset + int64(mementry.ValSize)
+		if valueEnd > datafileSize {
+			scanner.offset = previous
+			break
+		}
+
+		if valueEnd > end {
+			end = valueEnd
+		}
+	}
+
+	if err := f.Truncate(scanner.Offset()); err != nil {
+		return 0, 0, err
+	}
+
+	return stat.Size() - scanner.Offset(), end, nil
 }
 
 // InitDataFileScanner creates a new scanner that can read entries in a datafile one by one.
@@ -85,37 +197,129 @@ func InitHintScanner(hintFile *os.File) *HintScanner {
 	}
 }
 
+// Path returns the path of the hint file belonging to the datafile with the given id.
+func Path(directory string, id uint32) string {
+	return filepath.Join(directory, fmt.Sprintf("%v.hnt", id))
+}
+
 // NewHintFile creates a new hint file from a timestamp
 func NewHintFile(directory string, timestamp uint32) (*HintFile, error) {
-	path := filepath.Join(directory, fmt.Sprintf("%v.hnt", timestamp))
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, os.ModePerm)
+	return NewHintFileWithPath(Path(directory, timestamp), timestamp, 0)
+}
+
+// NewHintFileWithPath creates a new hint file at the given path for the datafile with the given id.
+// An existing hint file at the path is truncated, since it can't belong to a new datafile. The
+// keyID is the id of the key the datafile is encrypted with, or zero if it is not encrypted. The
+// keys in the hint file need to be encrypted with the same key.
+func NewHintFileWithPath(path string, id uint32, keyID uint16) (*HintFile, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.ModePerm)
 	if err != nil {
 		return nil, err
 	}
 
+	header := encoder.EncodeFileHeaderWithKey(encoder.HintMagic, id, uint32(time.Now().Unix()), keyID)
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+
 	return &HintFile{
 		File: f,
 	}, nil
 }
 
+// readHeader reads and checks the file header at the start of a hint file. It returns the format
+// version of the hint file and the id of the key the keys are encrypted with.
+func readHeader(f *os.File) (uint16, uint16, error) {
+	header := make([]byte, encoder.FileHeaderSize)
+	nBytes, err := f.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+
+	_, _, version, err := encoder.DecodeFileHeaderVersion(header[:nBytes], encoder.HintMagic)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return version, encoder.DecodeFileKeyID(header), nil
+}
+
 // AppendPathToKeyDir takes a hint file from path and then fills the given keydirectory pointer with
 // the key meta-data in the files. The dataFileID is also needed since it isn't stored in the hint-file.
-func AppendPathToKeyDir(path string, dataFileID uint32, kd *keydir.KeyDir) error {
+// The whole hint file is read before touching the keydirectory, so nothing is added if the hint file
+// is corrupt. The entries of a batch are ignored if the hint file doesn't contain its commit entry.
+// The keys of an encrypted hint file are decrypted with the matching key from the keyring.
+func AppendPathToKeyDir(path string, dataFileID uint32, kd *keydir.KeyDir, keyring encryption.Keyring) error {
 	f, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
+	_, keyID, err := readHeader(f)
+	if err != nil {
+		return err
+	}
+
+	c, err := keyring.Get(keyID)
+	if err != nil {
+		return err
+	}
+
+	var keys [][]byte
+	var entries []*keydir.MemEntry
+	var tombstones []bool
+
+	// batched is the amount of entries at the end that belong to a batch that hasn't been
+	// committed yet.
+	batched := 0
+
 	scanner := InitHintScanner(f)
 	for {
-		mementry, key, err := scanner.Scan()
-		if err != nil {
+		mementry, key, flags, err := scanner.ScanWithFlags()
+		if err == io.EOF {
 			break
 		}
 
+		if err != nil {
+			return err
+		}
+
+		if flags&encoder.FlagBatchCommit != 0 {
+			batched = 0
+			continue
+		}
+
+		if c != nil {
+			if key, err = c.Open(key, nil); err != nil {
+				return err
+			}
+		}
+
+		if flags&encoder.FlagBatch != 0 {
+			batched++
+		} else if batched > 0 {
+			// the batch was never committed, so its entries are dropped.
+			n := len(keys) - batched
+			keys, entries, tombstones = keys[:n], entries[:n], tombstones[:n]
+			batched = 0
+		}
+
 		mementry.FileID = dataFileID
-		kd.Put(string(key), mementry)
+		keys = append(keys, key)
+		entries = append(entries, mementry)
+		tombstones = append(tombstones, flags&encoder.FlagTombstone != 0)
+	}
+	n := len(keys) - batched
+
+	for i, key := range keys[:n] {
+		if tombstones[i] {
+			kd.DeleteWithTombstone(string(key), dataFileID)
+			continue
+		}
+
+		kd.Put(string(key), entries[i])
 	}
 
 	return nil
@@ -2,6 +2,7 @@ package hint_test
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -74,6 +75,9 @@ func TestEncodingDecoding(t *testing.T) {
 		t.Errorf("error reading data from the file: %s", err)
 	}
 
+	// skip the file header
+	data = data[encoder.FileHeaderSize:]
+
 	timestamp2, vsize2, offset2, key2, nBytes := encoder.DecodeHint(data)
 	if int(nBytes) != len(data) {
 		t.Errorf("wrong amount of data read")
@@ -123,6 +127,7 @@ func TestFillKeyDir(t *testing.T) {
 		filepath.Join(directory, fmt.Sprintf("%v.hnt", timestamp)),
 		timestamp,
 		kd,
+		nil,
 	); err != nil {
 		t.Errorf("error reading key directory from the hint file: %s", err)
 	}
@@ -188,3 +193,97 @@ func TestScanner(t *testing.T) {
 		}
 	}
 }
+
+func TestCorruptHintFile(t *testing.T) {
+	timestamp := uint32(time.Now().Unix())
+	directory := "./test"
+
+	createDirectoryIfNotExists(t, directory)
+
+	hintFile, err := hint.NewHintFile(directory, timestamp)
+	if err != nil {
+		t.Errorf("could not create hint file: %s", err)
+	}
+
+	for _, key := range []string{"test1", "test2"} {
+		if err := hintFile.Append(timestamp, 200, 200, []byte(key)); err != nil {
+			t.Errorf("could not append to hint file %s", err)
+		}
+	}
+
+	// cut the last entry in half
+	if err := hintFile.File.Truncate(30); err != nil {
+		t.Fatalf("could not truncate hint file: %s", err)
+	}
+	hintFile.Close()
+
+	kd := keydir.NewKeyDir()
+	if err := hint.AppendPathToKeyDir(hint.Path(directory, timestamp), timestamp, kd, nil); err == nil {
+		t.Errorf("reading a corrupt hint file didn't return an error")
+	}
+
+	if kd.Get("test1") != nil {
+		t.Errorf("entries from a corrupt hint file were added to the key directory")
+	}
+}
+
+func TestInvalidHeader(t *testing.T) {
+	timestamp := uint32(time.Now().Unix())
+	directory := "./test"
+
+	createDirectoryIfNotExists(t, directory)
+
+	if err := ioutil.WriteFile(hint.Path(directory, timestamp), []byte("not a hint file!"), 0777); err != nil {
+		t.Fatalf("could not write file: %s", err)
+	}
+
+	kd := keydir.NewKeyDir()
+	if err := hint.AppendPathToKeyDir(hint.Path(directory, timestamp), timestamp, kd, nil); !errors.Is(err, encoder.ErrInvalidMagic) {
+		t.Errorf("expected an invalid magic error. got=%v", err)
+	}
+}
+
+func TestUncommittedBatch(t *testing.T) {
+	directory := "./test"
+	createDirectoryIfNotExists(t, directory)
+
+	hintFile, err := hint.NewHintFile(directory, 1)
+	if err != nil {
+		t.Fatalf("could not create hint file: %s", err)
+	}
+
+	// a committed batch, a batch that was never committed and a normal entry.
+	appends := []struct {
+		key   string
+		flags byte
+	}{
+		{"committed", encoder.FlagBatch},
+		{"", encoder.FlagBatchCommit},
+		{"uncommitted", encoder.FlagBatch},
+		{"normal", 0},
+		{"trailing", encoder.FlagBatch},
+	}
+	for _, a := range appends {
+		if err := hintFile.AppendWithFlags(0, 5, 100, []byte(a.key), a.flags); err != nil {
+			t.Fatalf("could not append to hint file: %s", err)
+		}
+	}
+	hintFile.Close()
+
+	kd := keydir.NewKeyDir()
+	if err := hint.AppendPathToKeyDir(hint.Path(directory, 1), 1, kd, nil); err != nil {
+		t.Fatalf("error reading key directory from the hint file: %s", err)
+	}
+
+	for _, key := range []string{"committed", "normal"} {
+		if kd.Get(key) == nil {
+			t.Errorf("key %s was not found in the key directory", key)
+		}
+	}
+
+	for _, key := range []string{"", "uncommitted", "trailing"} {
+		if kd.Get(key) != nil {
+			t.Errorf("key %q from an uncommitted batch was found", key)
+		}
+	}
+}
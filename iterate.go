@@ -0,0 +1,112 @@
+package bitcask
+
+import (
+	"strings"
+)
+
+// prefixEnd returns the smallest key that is larger than all of the keys starting with prefix. An
+// empty string is returned if there is no such key.
+func prefixEnd(prefix []byte) string {
+	end := []byte(string(prefix))
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+
+	return ""
+}
+
+// Keys calls fn for each key in the database. The keys are collected before calling fn, so writes
+// can be made during the iteration, but keys added after the call started are not visited. The
+// iteration stops at the first error returned by fn and the error is returned. Expired keys are
+// skipped.
+func (db *DB) Keys(fn func(key []byte) error) error {
+	current := now()
+	for _, key := range db.KeyDir.Keys() {
+		if entry := db.KeyDir.Get(key); entry == nil || entry.Expired(current) {
+			continue
+		}
+
+		if err := fn([]byte(key)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Fold calls fn for each key-value pair in the database. Keys that are deleted during the iteration
+// are skipped. The iteration stops at the first error returned by fn and the error is returned.
+func (db *DB) Fold(fn func(key, value []byte) error) error {
+	return db.fold(db.KeyDir.Keys(), fn)
+}
+
+// Scan works like Fold, but only the keys starting with prefix are visited.
+func (db *DB) Scan(prefix []byte, fn func(key, value []byte) error) error {
+	var keys []string
+	for _, key := range db.KeyDir.Keys() {
+		if strings.HasPrefix(key, string(prefix)) {
+			keys = append(keys, key)
+		}
+	}
+
+	return db.fold(keys, fn)
+}
+
+// fold reads the values of the given keys and calls fn with each of them.
+func (db *DB) fold(keys []string, fn func(key, value []byte) error) error {
+	for _, key := range keys {
+		value, _, err := db.get([]byte(key))
+		if err == ErrKeyNotFound {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err := fn([]byte(key), value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Range calls fn for each key-value pair with a key in [start, end) in ascending order. A nil end
+// means that there is no upper bound. The keys are sorted in memory unless the database uses the
+// ordered index.
+func (db *DB) Range(start, end []byte, fn func(key, value []byte) error) error {
+	return db.fold(db.KeyDir.Range(string(start), string(end), false), fn)
+}
+
+// RangeReverse works like Range, but the keys are visited in descending order.
+func (db *DB) RangeReverse(start, end []byte, fn func(key, value []byte) error) error {
+	return db.fold(db.KeyDir.Range(string(start), string(end), true), fn)
+}
+
+// Prefix calls fn for each key-value pair with a key starting with prefix in ascending order.
+func (db *DB) Prefix(prefix []byte, fn func(key, value []byte) error) error {
+	return db.fold(db.KeyDir.Range(string(prefix), prefixEnd(prefix), false), fn)
+}
+
+// Seek returns the first key that is greater than or equal to key. ErrKeyNotFound is returned if
+// there is no such key. Expired keys are skipped.
+func (db *DB) Seek(key []byte) ([]byte, error) {
+	current := now()
+	for start := string(key); ; {
+		found, ok := db.KeyDir.Seek(start)
+		if !ok {
+			return nil, ErrKeyNotFound
+		}
+
+		if entry := db.KeyDir.Get(found); entry != nil && !entry.Expired(current) {
+			return []byte(found), nil
+		}
+
+		// the smallest key that is larger than found.
+		start = found + "\x00"
+	}
+}
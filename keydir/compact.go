@@ -0,0 +1,295 @@
+package keydir
+
+const (
+	// arenaChunkSize is the maximum size of the chunks the keys are stored in. The first chunk is
+	// minChunkSize bytes and each new chunk is twice as large as the previous one.
+	arenaChunkSize = 1 << 20
+	minChunkSize   = 4096
+
+	// entryBlockSize is the amount of entries in each entry block.
+	entryBlockSize = 1 << 12
+
+	// compactMinSlots is the initial size of the slot table.
+	compactMinSlots = 1024
+
+	// slots contain the position of an entry plus one, so these values can't be positions.
+	slotEmpty   uint32 = 0
+	slotDeleted uint32 = 1<<32 - 1
+)
+
+// compactEntry contains the metadata of a single key and the location of the key in the arenas.
+// It doesn't contain any pointers, so the garbage collector doesn't need to scan the entries.
+type compactEntry struct {
+	chunk     uint32
+	keyOffset uint32
+	keySize   uint32
+	fileID    uint32
+	valSize   uint32
+	timestamp uint32
+	expiry    uint32
+	codec     byte
+	valOffset int64
+}
+
+// compactIndex is a hash index that stores the keys in large byte arenas and the entries in fixed
+// size blocks. The hash table itself only contains 4 byte positions of the entries. Compared to
+// hashIndex it doesn't need any allocations per key, which lowers the memory usage when there
+// are a lot of keys. The entries returned by get are created on each call.
+type compactIndex struct {
+	slots   []uint32
+	length  int
+	deleted int
+
+	blocks [][]compactEntry
+	count  int
+
+	// free contains the positions of the entries of removed keys, so they can be reused.
+	free []uint32
+
+	chunks [][]byte
+
+	// arena is the amount of bytes used in the chunks and garbage is the amount of those bytes
+	// taken by removed keys.
+	arena   int
+	garbage int
+}
+
+func newCompactIndex() *compactIndex {
+	return &compactIndex{
+		slots: make([]uint32, compactMinSlots),
+	}
+}
+
+// hashKey returns the fnv-1a hash of a key.
+func hashKey(key []byte) uint32 {
+	h := uint32(2166136261)
+	for _, b := range key {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+
+	return h
+}
+
+// entry returns the entry at the given position.
+func (c *compactIndex) entry(pos uint32) *compactEntry {
+	return &c.blocks[pos/entryBlockSize][pos%entryBlockSize]
+}
+
+// key returns the key of an entry without copying it.
+func (c *compactIndex) key(e *compactEntry) []byte {
+	return c.chunks[e.chunk][e.keyOffset : e.keyOffset+e.keySize]
+}
+
+// find returns the index of the slot containing key or -1 if the key isn't in the table.
+func (c *compactIndex) find(key string) int {
+	mask := uint32(len(c.slots) - 1)
+	for i := hashKey([]byte(key)) & mask; ; i = (i + 1) & mask {
+		switch s := c.slots[i]; s {
+		case slotEmpty:
+			return -1
+		case slotDeleted:
+			continue
+		default:
+			if string(c.key(c.entry(s-1))) == key {
+				return int(i)
+			}
+		}
+	}
+}
+
+// insert places the position of an entry into the first free slot. The key must not already be
+// in the table.
+func (c *compactIndex) insert(pos uint32, key []byte) {
+	mask := uint32(len(c.slots) - 1)
+	for i := hashKey(key) & mask; ; i = (i + 1) & mask {
+		if c.slots[i] == slotEmpty || c.slots[i] == slotDeleted {
+			if c.slots[i] == slotDeleted {
+				c.deleted--
+			}
+
+			c.slots[i] = pos + 1
+			c.length++
+			return
+		}
+	}
+}
+
+// resize rebuilds the slot table with the given amount of slots.
+func (c *compactIndex) resize(size int) {
+	old := c.slots
+	c.slots = make([]uint32, size)
+	c.length = 0
+	c.deleted = 0
+
+	for _, s := range old {
+		if s != slotEmpty && s != slotDeleted {
+			c.insert(s-1, c.key(c.entry(s-1)))
+		}
+	}
+}
+
+// allocEntry returns the position of an unused entry.
+func (c *compactIndex) allocEntry() uint32 {
+	if len(c.free) > 0 {
+		pos := c.free[len(c.free)-1]
+		c.free = c.free[:len(c.free)-1]
+		return pos
+	}
+
+	if c.count%entryBlockSize == 0 {
+		c.blocks = append(c.blocks, make([]compactEntry, entryBlockSize))
+	}
+	c.count++
+
+	return uint32(c.count - 1)
+}
+
+// allocKey reserves space for a key of the given size in the arena and returns its location.
+func (c *compactIndex) allocKey(size int) (uint32, uint32) {
+	last := len(c.chunks) - 1
+	if last < 0 || len(c.chunks[last])+size > cap(c.chunks[last]) {
+		chunkSize := minChunkSize
+		if last >= 0 && 2*cap(c.chunks[last]) > chunkSize {
+			chunkSize = 2 * cap(c.chunks[last])
+		}
+
+		if chunkSize > arenaChunkSize {
+			chunkSize = arenaChunkSize
+		}
+
+		if size > chunkSize {
+			chunkSize = size
+		}
+
+		c.chunks = append(c.chunks, make([]byte, 0, chunkSize))
+		last++
+	}
+
+	offset := len(c.chunks[last])
+	c.chunks[last] = c.chunks[last][:offset+size]
+	c.arena += size
+
+	return uint32(last), uint32(offset)
+}
+
+// compactArena copies the live keys into new arenas such that the space taken by removed keys
+// is reclaimed.
+func (c *compactIndex) compactArena() {
+	old := c.chunks
+	c.chunks = nil
+	c.arena = 0
+	c.garbage = 0
+
+	for _, s := range c.slots {
+		if s == slotEmpty || s == slotDeleted {
+			continue
+		}
+
+		e := c.entry(s - 1)
+		key := old[e.chunk][e.keyOffset : e.keyOffset+e.keySize]
+		e.chunk, e.keyOffset = c.allocKey(len(key))
+		copy(c.key(e), key)
+	}
+}
+
+func (c *compactIndex) get(key string) (*MemEntry, bool) {
+	i := c.find(key)
+	if i < 0 {
+		return nil, false
+	}
+
+	e := c.entry(c.slots[i] - 1)
+	return &MemEntry{
+		FileID:    e.fileID,
+		ValOffset: e.valOffset,
+		ValSize:   e.valSize,
+		Timestamp: e.timestamp,
+		Expiry:    e.expiry,
+		Codec:     e.codec,
+	}, true
+}
+
+func (c *compactIndex) set(key string, entry *MemEntry) {
+	if i := c.find(key); i >= 0 {
+		e := c.entry(c.slots[i] - 1)
+		e.fileID = entry.FileID
+		e.valOffset = entry.ValOffset
+		e.valSize = entry.ValSize
+		e.timestamp = entry.Timestamp
+		e.expiry = entry.Expiry
+		e.codec = entry.Codec
+		return
+	}
+
+	// keep the load factor under 75% including the deleted slots.
+	if (c.length+c.deleted+1)*4 > len(c.slots)*3 {
+		size := len(c.slots)
+		if (c.length+1)*2 > size {
+			size *= 2
+		}
+		c.resize(size)
+	}
+
+	if c.garbage > arenaChunkSize && c.garbage*2 > c.arena {
+		c.compactArena()
+	}
+
+	pos := c.allocEntry()
+	e := c.entry(pos)
+	*e = compactEntry{
+		keySize:   uint32(len(key)),
+		fileID:    entry.FileID,
+		valSize:   entry.ValSize,
+		timestamp: entry.Timestamp,
+		expiry:    entry.Expiry,
+		codec:     entry.Codec,
+		valOffset: entry.ValOffset,
+	}
+	e.chunk, e.keyOffset = c.allocKey(len(key))
+	copy(c.key(e), key)
+
+	c.insert(pos, c.key(e))
+}
+
+func (c *compactIndex) remove(key string) {
+	i := c.find(key)
+	if i < 0 {
+		return
+	}
+
+	pos := c.slots[i] - 1
+	c.garbage += int(c.entry(pos).keySize)
+	*c.entry(pos) = compactEntry{}
+	c.free = append(c.free, pos)
+
+	c.slots[i] = slotDeleted
+	c.length--
+	c.deleted++
+}
+
+func (c *compactIndex) len() int {
+	return c.length
+}
+
+func (c *compactIndex) each(fn func(key string, entry *MemEntry) bool) {
+	for _, s := range c.slots {
+		if s == slotEmpty || s == slotDeleted {
+			continue
+		}
+
+		e := c.entry(s - 1)
+		entry := &MemEntry{
+			FileID:    e.fileID,
+			ValOffset: e.valOffset,
+			ValSize:   e.valSize,
+			Timestamp: e.timestamp,
+			Expiry:    e.expiry,
+			Codec:     e.codec,
+		}
+
+		if !fn(string(c.key(e)), entry) {
+			return
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package keydir
+
+import (
+	"math/rand"
+	"time"
+)
+
+// index stores the entries of a key directory. The key directory takes care of the locking.
+type index interface {
+	get(key string) (*MemEntry, bool)
+	set(key string, entry *MemEntry)
+	remove(key string)
+	len() int
+
+	// each calls fn for each of the entries in any order until fn returns false.
+	each(fn func(key string, entry *MemEntry) bool)
+}
+
+// orderedIndex is an index that keeps the keys in sorted order.
+type orderedIndex interface {
+	index
+
+	// ascend calls fn for each of the entries with a key greater than or equal to start in
+	// ascending order until fn returns false.
+	ascend(start string, fn func(key string, entry *MemEntry) bool)
+}
+
+// hashIndex is the default index. It has the fastest point lookups, but it isn't ordered.
+type hashIndex map[string]*MemEntry
+
+func (h hashIndex) get(key string) (*MemEntry, bool) {
+	entry, ok := h[key]
+	return entry, ok
+}
+
+func (h hashIndex) set(key string, entry *MemEntry) {
+	h[key] = entry
+}
+
+func (h hashIndex) remove(key string) {
+	delete(h, key)
+}
+
+func (h hashIndex) len() int {
+	return len(h)
+}
+
+func (h hashIndex) each(fn func(key string, entry *MemEntry) bool) {
+	for key, entry := range h {
+		if !fn(key, entry) {
+			return
+		}
+	}
+}
+
+const (
+	// skiplistMaxLevel is enough for 4^32 keys with skiplistP.
+	skiplistMaxLevel = 32
+
+	// skiplistP is the inverse of the probability that a node is also on the next level.
+	skiplistP = 4
+)
+
+// skiplist is an ordered index. Seeking to a key takes O(log n) time and the next key is found
+// in constant time.
+type skiplist struct {
+	head   *skipNode
+	level  int
+	length int
+	rand   *rand.Rand
+}
+
+type skipNode struct {
+	key   string
+	entry *MemEntry
+	next  []*skipNode
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		head:  &skipNode{next: make([]*skipNode, skiplistMaxLevel)},
+		level: 1,
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// randomLevel returns the level of a new node.
+func (s *skiplist) randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && s.rand.Intn(skiplistP) == 0 {
+		level++
+	}
+
+	return level
+}
+
+// findGreaterOrEqual returns the first node with a key greater than or equal to key. If update is
+// given, it is filled with the last node before the key on each level.
+func (s *skiplist) findGreaterOrEqual(key string, update []*skipNode) *skipNode {
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+
+		if update != nil {
+			update[i] = x
+		}
+	}
+
+	return x.next[0]
+}
+
+func (s *skiplist) get(key string) (*MemEntry, bool) {
+	x := s.findGreaterOrEqual(key, nil)
+	if x == nil || x.key != key {
+		return nil, false
+	}
+
+	return x.entry, true
+}
+
+func (s *skiplist) set(key string, entry *MemEntry) {
+	update := make([]*skipNode, skiplistMaxLevel)
+	x := s.findGreaterOrEqual(key, update)
+	if x != nil && x.key == key {
+		x.entry = entry
+		return
+	}
+
+	level := s.randomLevel()
+	if level > s.level {
+		for i := s.level; i < level; i++ {
+			update[i] = s.head
+		}
+		s.level = level
+	}
+
+	node := &skipNode{
+		key:   key,
+		entry: entry,
+		next:  make([]*skipNode, level),
+	}
+
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	s.length++
+}
+
+func (s *skiplist) remove(key string) {
+	update := make([]*skipNode, skiplistMaxLevel)
+	x := s.findGreaterOrEqual(key, update)
+	if x == nil || x.key != key {
+		return
+	}
+
+	for i := 0; i < s.level; i++ {
+		if update[i].next[i] != x {
+			break
+		}
+		update[i].next[i] = x.next[i]
+	}
+
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+	s.length--
+}
+
+func (s *skiplist) len() int {
+	return s.length
+}
+
+func (s *skiplist) each(fn func(key string, entry *MemEntry) bool) {
+	s.ascend("", fn)
+}
+
+func (s *skiplist) ascend(start string, fn func(key string, entry *MemEntry) bool) {
+	for x := s.findGreaterOrEqual(start, nil); x != nil; x = x.next[0] {
+		if !fn(x.key, x.entry) {
+			return
+		}
+	}
+}
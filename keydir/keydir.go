@@ -1,48 +1,429 @@
 package keydir
 
-import "sync"
+import (
+	"sort"
+	"sync"
+
+	"github.com/nireo/bitcask/encoder"
+)
 
 type MemEntry struct {
 	FileID    uint32
 	ValOffset int64
 	ValSize   uint32
 	Timestamp uint32
+
+	// Expiry is the unix time after which the key has expired. Zero means that the key never
+	// expires.
+	Expiry uint32
+
+	// Codec is the compression codec of the value. Zero means that the value is not compressed.
+	Codec byte
+}
+
+// Expired returns true if the key has expired at the given unix time.
+func (m *MemEntry) Expired(now uint32) bool {
+	return m.Expiry != 0 && now >= m.Expiry
+}
+
+// Equal returns true if both of the entries point to the same value. Two nil entries are equal.
+func (m *MemEntry) Equal(other *MemEntry) bool {
+	if m == nil || other == nil {
+		return m == other
+	}
+
+	return *m == *other
 }
 
-var keyDirLock = &sync.RWMutex{}
+// ShardCount is the amount of segments a key directory is split into. Each segment has its own
+// lock, so operations on keys in different segments don't block each other.
+const ShardCount = 32
+
+// shardBits is log2(ShardCount).
+const shardBits = 5
 
 type KeyDir struct {
-	entries map[string]*MemEntry
+	shards [ShardCount]*shard
+}
+
+// shard is a segment of the key directory. The stats of a datafile are split between the shards,
+// since the keys of a datafile are in every shard.
+type shard struct {
+	sync.RWMutex
+	entries index
+
+	// stats contains the live and dead entry counters for each datafile.
+	stats map[uint32]*FileStats
+
+	// overheads contains the amount of bytes each entry takes in a datafile in addition to its key
+	// and value. The datafiles without an overhead use the entry header size of the current format.
+	overheads map[uint32]int64
 }
 
-// NewKeyDir creates a new instance of a key directory.
+// FileStats contains information about how much of a datafile is live data and how much of it
+// has been overwritten or deleted. Tombstones are counted separately, since they can only be
+// dropped once there are no older datafiles that could contain the deleted values.
+type FileStats struct {
+	LiveKeys  int64
+	LiveBytes int64
+	DeadKeys  int64
+	DeadBytes int64
+
+	Tombstones     int64
+	TombstoneBytes int64
+}
+
+// Fragmentation returns the percentage of dead bytes in the datafile.
+func (fs FileStats) Fragmentation() int {
+	total := fs.LiveBytes + fs.DeadBytes + fs.TombstoneBytes
+	if total == 0 {
+		return 0
+	}
+
+	return int(fs.DeadBytes * 100 / total)
+}
+
+// NewKeyDir creates a new instance of a key directory. The keys are stored in a hash map, so
+// ordered iteration needs to sort the keys.
 func NewKeyDir() *KeyDir {
-	return &KeyDir{
-		entries: make(map[string]*MemEntry),
+	return newKeyDir(func() index { return make(hashIndex) })
+}
+
+// NewCompactKeyDir creates a key directory that packs the keys and their metadata into large
+// arenas. It uses less memory than NewKeyDir when there are a lot of keys, but every lookup has to
+// create a new MemEntry.
+func NewCompactKeyDir() *KeyDir {
+	return newKeyDir(func() index { return newCompactIndex() })
+}
+
+// NewOrderedKeyDir creates a key directory that keeps the keys in sorted order. Range queries
+// don't need to sort the keys, but point lookups are slower than with NewKeyDir.
+func NewOrderedKeyDir() *KeyDir {
+	return newKeyDir(func() index { return newSkiplist() })
+}
+
+func newKeyDir(newIndex func() index) *KeyDir {
+	kd := &KeyDir{}
+	for i := range kd.shards {
+		kd.shards[i] = &shard{
+			entries:   newIndex(),
+			stats:     make(map[uint32]*FileStats),
+			overheads: make(map[uint32]int64),
+		}
 	}
+
+	return kd
+}
+
+// shard returns the shard a key belongs to. The top bits of the hash are used, since the indexes
+// use the low bits of the same hash.
+func (kd *KeyDir) shard(key string) *shard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+
+	return kd.shards[h>>(32-shardBits)]
+}
+
+// entrySize returns the amount of bytes an entry takes in a datafile. This contains the header
+// and the key and value as they are stored in the datafile. The caller needs to hold the lock of
+// the shard.
+func (s *shard) entrySize(fileID uint32, key string, valSize uint32) int64 {
+	overhead, ok := s.overheads[fileID]
+	if !ok {
+		overhead = encoder.EntryHeaderSize
+	}
+
+	return overhead + int64(len(key)) + int64(valSize)
+}
+
+// SetEntryOverhead sets the amount of bytes each entry takes in a datafile in addition to its key
+// and value. It needs to be set before the entries of the datafile are added, if the datafile
+// uses an older format version or encryption.
+func (kd *KeyDir) SetEntryOverhead(id uint32, overhead int64) {
+	for _, s := range kd.shards {
+		s.Lock()
+		s.overheads[id] = overhead
+		s.Unlock()
+	}
+}
+
+// fileStats returns the stats for a given file and creates them if needed. The caller needs to
+// hold the lock of the shard.
+func (s *shard) fileStats(id uint32) *FileStats {
+	stats, ok := s.stats[id]
+	if !ok {
+		stats = &FileStats{}
+		s.stats[id] = stats
+	}
+
+	return stats
+}
+
+// markDead moves an entry from the live counters to the dead counters. The caller needs to hold
+// the lock of the shard.
+func (s *shard) markDead(key string, entry *MemEntry) {
+	stats := s.fileStats(entry.FileID)
+	size := s.entrySize(entry.FileID, key, entry.ValSize)
+
+	stats.LiveKeys--
+	stats.LiveBytes -= size
+	stats.DeadKeys++
+	stats.DeadBytes += size
 }
 
 // Get gets key metadata with a given key.
 func (kd *KeyDir) Get(key string) *MemEntry {
-	keyDirLock.RLock()
-	defer keyDirLock.RUnlock()
+	s := kd.shard(key)
+	s.RLock()
+	defer s.RUnlock()
 
-	entry, _ := kd.entries[key]
+	entry, _ := s.entries.get(key)
 	return entry
 }
 
+// each calls fn for each of the entries in every shard. Each shard is locked while its entries
+// are visited, so the result isn't consistent across shards if there are concurrent writes.
+func (kd *KeyDir) each(fn func(key string, entry *MemEntry)) {
+	for _, s := range kd.shards {
+		s.RLock()
+		s.entries.each(func(key string, entry *MemEntry) bool {
+			fn(key, entry)
+			return true
+		})
+		s.RUnlock()
+	}
+}
+
+// Copy returns a copy of all of the keys and their metadata. The entries themselves are shared,
+// since they are never modified after being added.
+func (kd *KeyDir) Copy() map[string]*MemEntry {
+	entries := make(map[string]*MemEntry, kd.Len())
+	kd.each(func(key string, entry *MemEntry) {
+		entries[key] = entry
+	})
+
+	return entries
+}
+
+// Keys returns all of the keys in the key directory.
+func (kd *KeyDir) Keys() []string {
+	keys := make([]string, 0, kd.Len())
+	kd.each(func(key string, entry *MemEntry) {
+		keys = append(keys, key)
+	})
+
+	return keys
+}
+
+// ExpiredKeys returns the keys that have expired at the given unix time.
+func (kd *KeyDir) ExpiredKeys(now uint32) []string {
+	var keys []string
+	kd.each(func(key string, entry *MemEntry) {
+		if entry.Expired(now) {
+			keys = append(keys, key)
+		}
+	})
+
+	return keys
+}
+
+// Range returns the keys in [start, end) in ascending order, or in descending order if reverse
+// is set. An empty end means that there is no upper bound.
+func (kd *KeyDir) Range(start, end string, reverse bool) []string {
+	var keys []string
+	if _, ok := kd.shards[0].entries.(orderedIndex); ok {
+		// each shard is already sorted, so they only need to be merged.
+		lists := make([][]string, len(kd.shards))
+		for i, s := range kd.shards {
+			s.RLock()
+			s.entries.(orderedIndex).ascend(start, func(key string, entry *MemEntry) bool {
+				if end != "" && key >= end {
+					return false
+				}
+
+				lists[i] = append(lists[i], key)
+				return true
+			})
+			s.RUnlock()
+		}
+		keys = mergeSorted(lists)
+	} else {
+		kd.each(func(key string, entry *MemEntry) {
+			if key >= start && (end == "" || key < end) {
+				keys = append(keys, key)
+			}
+		})
+		sort.Strings(keys)
+	}
+
+	if reverse {
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	}
+
+	return keys
+}
+
+// mergeSorted merges sorted lists of keys into a single sorted list.
+func mergeSorted(lists [][]string) []string {
+	total := 0
+	for _, list := range lists {
+		total += len(list)
+	}
+
+	keys := make([]string, 0, total)
+	for len(keys) < total {
+		min := -1
+		for i, list := range lists {
+			if len(list) > 0 && (min < 0 || list[0] < lists[min][0]) {
+				min = i
+			}
+		}
+
+		keys = append(keys, lists[min][0])
+		lists[min] = lists[min][1:]
+	}
+
+	return keys
+}
+
+// Seek returns the first key that is greater than or equal to key. The bool is false if there is
+// no such key.
+func (kd *KeyDir) Seek(key string) (string, bool) {
+	var found string
+	ok := false
+
+	if _, isOrdered := kd.shards[0].entries.(orderedIndex); isOrdered {
+		for _, s := range kd.shards {
+			s.RLock()
+			s.entries.(orderedIndex).ascend(key, func(k string, entry *MemEntry) bool {
+				if !ok || k < found {
+					found, ok = k, true
+				}
+				return false
+			})
+			s.RUnlock()
+		}
+
+		return found, ok
+	}
+
+	kd.each(func(k string, entry *MemEntry) {
+		if k >= key && (!ok || k < found) {
+			found, ok = k, true
+		}
+	})
+
+	return found, ok
+}
+
+// Len returns the amount of keys in the key directory.
+func (kd *KeyDir) Len() int {
+	n := 0
+	for _, s := range kd.shards {
+		s.RLock()
+		n += s.entries.len()
+		s.RUnlock()
+	}
+
+	return n
+}
+
 // Put adds a key with some metadata into the key directory.
 func (kd *KeyDir) Put(key string, data *MemEntry) {
-	keyDirLock.Lock()
-	defer keyDirLock.Unlock()
+	s := kd.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	if previous, ok := s.entries.get(key); ok {
+		s.markDead(key, previous)
+	}
+
+	stats := s.fileStats(data.FileID)
+	stats.LiveKeys++
+	stats.LiveBytes += s.entrySize(data.FileID, key, data.ValSize)
 
-	kd.entries[key] = data
+	s.entries.set(key, data)
 }
 
 // Delete removes the key metadata from the key directory
 func (kd *KeyDir) Delete(key string) {
-	keyDirLock.Lock()
-	defer keyDirLock.Unlock()
+	s := kd.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	if previous, ok := s.entries.get(key); ok {
+		s.markDead(key, previous)
+	}
+
+	s.entries.remove(key)
+}
+
+// DeleteWithTombstone removes the key metadata from the key directory and counts the tombstone
+// entry that deleted it in the datafile with the given id. Tombstones are never live, but they are
+// not counted as dead bytes either.
+func (kd *KeyDir) DeleteWithTombstone(key string, fileID uint32) {
+	s := kd.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	if previous, ok := s.entries.get(key); ok {
+		s.markDead(key, previous)
+	}
+	s.entries.remove(key)
+
+	stats := s.fileStats(fileID)
+	stats.Tombstones++
+	stats.TombstoneBytes += s.entrySize(fileID, key, 0)
+}
+
+// Stats returns a copy of the live and dead entry counters of each datafile.
+func (kd *KeyDir) Stats() map[uint32]FileStats {
+	stats := make(map[uint32]FileStats)
+	for _, s := range kd.shards {
+		s.RLock()
+		for id, fs := range s.stats {
+			total := stats[id]
+			total.LiveKeys += fs.LiveKeys
+			total.LiveBytes += fs.LiveBytes
+			total.DeadKeys += fs.DeadKeys
+			total.DeadBytes += fs.DeadBytes
+			total.Tombstones += fs.Tombstones
+			total.TombstoneBytes += fs.TombstoneBytes
+			stats[id] = total
+		}
+		s.RUnlock()
+	}
+
+	return stats
+}
 
-	delete(kd.entries, key)
+// SetStats replaces the counters of a datafile. This is used when a datafile has been rewritten
+// by a merge. The counters are stored in the first shard.
+func (kd *KeyDir) SetStats(id uint32, stats FileStats) {
+	for _, s := range kd.shards {
+		s.Lock()
+		delete(s.stats, id)
+		s.Unlock()
+	}
+
+	s := kd.shards[0]
+	s.Lock()
+	defer s.Unlock()
+
+	s.stats[id] = &stats
+}
+
+// DeleteStats removes the counters and the entry overhead of a datafile that no longer exists.
+func (kd *KeyDir) DeleteStats(id uint32) {
+	for _, s := range kd.shards {
+		s.Lock()
+		delete(s.stats, id)
+		delete(s.overheads, id)
+		s.Unlock()
+	}
 }
@@ -0,0 +1,192 @@
+package keydir_test
+
+import (
+	"math/rand"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nireo/bitcask/encoder"
+	"github.com/nireo/bitcask/keydir"
+)
+
+func TestStats(t *testing.T) {
+	kd := keydir.NewKeyDir()
+
+	kd.Put("key1", &keydir.MemEntry{FileID: 1, ValSize: 10})
+	kd.Put("key2", &keydir.MemEntry{FileID: 1, ValSize: 10})
+	kd.Put("key1", &keydir.MemEntry{FileID: 2, ValSize: 20})
+	kd.Delete("key2")
+
+	stats := kd.Stats()
+	entrySize := int64(encoder.EntryHeaderSize + 4)
+
+	// both of the entries in the first file are dead.
+	want := keydir.FileStats{LiveKeys: 0, LiveBytes: 0, DeadKeys: 2, DeadBytes: 2*entrySize + 20}
+	if stats[1] != want {
+		t.Errorf("wrong stats for file 1. got=%+v want=%+v", stats[1], want)
+	}
+
+	want = keydir.FileStats{LiveKeys: 1, LiveBytes: entrySize + 20, DeadKeys: 0, DeadBytes: 0}
+	if stats[2] != want {
+		t.Errorf("wrong stats for file 2. got=%+v want=%+v", stats[2], want)
+	}
+
+	if stats[1].Fragmentation() != 100 {
+		t.Errorf("wrong fragmentation. got=%d want=100", stats[1].Fragmentation())
+	}
+
+	// the tombstone is not a dead entry, but the value it deleted is.
+	kd.DeleteWithTombstone("key1", 3)
+	stats = kd.Stats()
+
+	want = keydir.FileStats{Tombstones: 1, TombstoneBytes: entrySize}
+	if stats[3] != want {
+		t.Errorf("wrong stats for file 3. got=%+v want=%+v", stats[3], want)
+	}
+
+	if stats[2].DeadKeys != 1 || stats[3].Fragmentation() != 0 {
+		t.Errorf("wrong stats after deleting. got=%+v,%+v", stats[2], stats[3])
+	}
+}
+
+func TestOrderedKeyDir(t *testing.T) {
+	for _, kd := range []*keydir.KeyDir{keydir.NewKeyDir(), keydir.NewOrderedKeyDir(), keydir.NewCompactKeyDir()} {
+		for _, key := range []string{"d", "a", "c", "e", "b", "f"} {
+			kd.Put(key, &keydir.MemEntry{FileID: 1})
+		}
+		kd.Delete("e")
+		kd.Put("c", &keydir.MemEntry{FileID: 2})
+
+		if kd.Len() != 5 {
+			t.Errorf("wrong amount of keys. got=%d want=5", kd.Len())
+		}
+
+		if got := strings.Join(kd.Range("b", "f", false), ""); got != "bcd" {
+			t.Errorf("wrong range. got=%s want=bcd", got)
+		}
+
+		if got := strings.Join(kd.Range("", "", true), ""); got != "fdcba" {
+			t.Errorf("wrong reverse range. got=%s want=fdcba", got)
+		}
+
+		if key, ok := kd.Seek("e"); !ok || key != "f" {
+			t.Errorf("wrong seek result. got=%s,%v want=f", key, ok)
+		}
+
+		if _, ok := kd.Seek("g"); ok {
+			t.Errorf("seek found a key past the last key")
+		}
+
+		if entry := kd.Get("c"); entry == nil || entry.FileID != 2 {
+			t.Errorf("wrong entry for an overwritten key. got=%+v", entry)
+		}
+	}
+}
+
+func TestCompactKeyDir(t *testing.T) {
+	kd := keydir.NewCompactKeyDir()
+	reference := make(map[string]keydir.MemEntry)
+
+	// random puts and deletes such that the table is resized and deleted slots are reused.
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		key := "key" + strconv.Itoa(r.Intn(20000))
+		if r.Intn(3) == 0 {
+			kd.Delete(key)
+			delete(reference, key)
+			continue
+		}
+
+		entry := keydir.MemEntry{FileID: uint32(i), ValOffset: int64(i), ValSize: uint32(i), Timestamp: uint32(i)}
+		kd.Put(key, &entry)
+		reference[key] = entry
+	}
+
+	if kd.Len() != len(reference) {
+		t.Fatalf("wrong amount of keys. got=%d want=%d", kd.Len(), len(reference))
+	}
+
+	for key, want := range reference {
+		if got := kd.Get(key); got == nil || *got != want {
+			t.Fatalf("wrong entry for key %s. got=%+v want=%+v", key, got, want)
+		}
+	}
+
+	for _, key := range kd.Keys() {
+		if _, ok := reference[key]; !ok {
+			t.Fatalf("deleted key %s was found", key)
+		}
+	}
+}
+
+// BenchmarkKeyDirMemory reports the amount of heap memory each key takes in the different key
+// directory implementations.
+func BenchmarkKeyDirMemory(b *testing.B) {
+	const keys = 1000000
+
+	implementations := []struct {
+		name string
+		new  func() *keydir.KeyDir
+	}{
+		{"hash", keydir.NewKeyDir},
+		{"ordered", keydir.NewOrderedKeyDir},
+		{"compact", keydir.NewCompactKeyDir},
+	}
+
+	for _, impl := range implementations {
+		b.Run(impl.name, func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				kd := impl.new()
+				for i := 0; i < keys; i++ {
+					kd.Put("key"+strconv.Itoa(i), &keydir.MemEntry{FileID: 1, ValOffset: int64(i), ValSize: 100})
+				}
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/keys, "bytes/key")
+				runtime.KeepAlive(kd)
+			}
+		})
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	kd := keydir.NewKeyDir()
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+
+			for i := 0; i < 1000; i++ {
+				key := strconv.Itoa(worker) + "-" + strconv.Itoa(i)
+				kd.Put(key, &keydir.MemEntry{FileID: 1, ValSize: 10})
+				if kd.Get(key) == nil {
+					t.Errorf("key %s was not found after put", key)
+				}
+
+				if i%2 == 0 {
+					kd.Delete(key)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	if kd.Len() != 4000 {
+		t.Errorf("wrong amount of keys. got=%d want=4000", kd.Len())
+	}
+
+	stats := kd.Stats()[1]
+	if stats.LiveKeys != 4000 || stats.DeadKeys != 4000 {
+		t.Errorf("wrong stats. got=%+v", stats)
+	}
+}
@@ -0,0 +1,77 @@
+package bitcask
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/nireo/bitcask/datafile"
+	"github.com/nireo/bitcask/encoder"
+	"github.com/nireo/bitcask/encryption"
+)
+
+const (
+	// maxEncodedSize is the largest key or value the entry format can store. The sizes are stored
+	// as uint32 and the encryption makes the stored data longer.
+	maxEncodedSize = math.MaxUint32 - encryption.Overhead
+
+	// maxEntrySize is the largest entry that can be read, since the whole entry is read with a
+	// uint32 length when the checksums are verified.
+	maxEntrySize = math.MaxUint32
+)
+
+var (
+	ErrEmptyKey      = errors.New("the key is empty")
+	ErrKeyTooLarge   = errors.New("the key is too large")
+	ErrValueTooLarge = errors.New("the value is too large")
+)
+
+// limit returns the smaller of the configured limit and the limit of the entry format. A zero
+// limit means that only the format limit applies.
+func limit(configured int) int64 {
+	if configured <= 0 || int64(configured) > maxEncodedSize {
+		return maxEncodedSize
+	}
+
+	return int64(configured)
+}
+
+// checkKey returns an error if the key is empty or larger than Options.MaxKeySize.
+func (db *DB) checkKey(key []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+
+	if max := limit(db.Options.MaxKeySize); int64(len(key)) > max {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrKeyTooLarge, len(key), max)
+	}
+
+	return nil
+}
+
+// checkEntries returns an error if any of the entries has a key or a value that can't be written.
+// Nothing is written if an error is returned.
+func (db *DB) checkEntries(entries []*datafile.Entry) error {
+	for _, entry := range entries {
+		// commit entries are created by the database itself.
+		if entry.Commit {
+			continue
+		}
+
+		if err := db.checkKey(entry.Key); err != nil {
+			return err
+		}
+
+		if max := limit(db.Options.MaxValueSize); int64(len(entry.Value)) > max {
+			return fmt.Errorf("%w: %d bytes, the limit is %d", ErrValueTooLarge, len(entry.Value), max)
+		}
+
+		// the key and the value can be under their own limits but too large together.
+		size := encoder.EntryHeaderSize + 2*encryption.Overhead + int64(len(entry.Key)) + int64(len(entry.Value))
+		if size > maxEntrySize {
+			return fmt.Errorf("%w: the entry would be %d bytes, the limit is %d", ErrValueTooLarge, size, int64(maxEntrySize))
+		}
+	}
+
+	return nil
+}
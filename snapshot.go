@@ -0,0 +1,132 @@
+package bitcask
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/nireo/bitcask/keydir"
+)
+
+var (
+	ErrSnapshotReleased = errors.New("the snapshot has been released")
+)
+
+// Snapshot is a read-only view of the database at the point in time it was created. Writes made
+// after the snapshot was taken are not visible through it. The datafiles the snapshot references
+// are not merged until the snapshot is released, so Release should always be called.
+type Snapshot struct {
+	db      *DB
+	entries map[string]*keydir.MemEntry
+	files   []uint32
+
+	mu       sync.RWMutex
+	released bool
+}
+
+// Snapshot creates a new snapshot of the database.
+func (db *DB) Snapshot() *Snapshot {
+	// the writes update the key directory while holding the write lock, so the copy is consistent.
+	db.rwmutex.RLock()
+	defer db.rwmutex.RUnlock()
+
+	files := make([]uint32, 0, len(db.Manager)+1)
+	for id := range db.Manager {
+		files = append(files, id)
+	}
+	files = append(files, db.WFile.ID())
+
+	db.pinnedMutex.Lock()
+	for _, id := range files {
+		db.pinned[id]++
+	}
+	db.pinnedMutex.Unlock()
+
+	return &Snapshot{
+		db:      db,
+		entries: db.KeyDir.Copy(),
+		files:   files,
+	}
+}
+
+// Get returns the value the key had when the snapshot was taken.
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.released {
+		return nil, ErrSnapshotReleased
+	}
+
+	entry, ok := s.entries[string(key)]
+	if !ok || entry.Expired(now()) {
+		return nil, ErrKeyNotFound
+	}
+
+	s.db.rwmutex.RLock()
+	defer s.db.rwmutex.RUnlock()
+
+	return s.db.readValue(key, entry)
+}
+
+// Fold calls fn for each key-value pair in the snapshot. Keys that have expired by the time they
+// are visited are skipped. The iteration stops at the first error returned by fn and the error is
+// returned.
+func (s *Snapshot) Fold(fn func(key, value []byte) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.released {
+		return ErrSnapshotReleased
+	}
+
+	for key, entry := range s.entries {
+		if entry.Expired(now()) {
+			continue
+		}
+
+		s.db.rwmutex.RLock()
+		value, err := s.db.readValue([]byte(key), entry)
+		s.db.rwmutex.RUnlock()
+
+		if err != nil {
+			return err
+		}
+
+		if err := fn([]byte(key), value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Len returns the amount of keys in the snapshot.
+func (s *Snapshot) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.entries)
+}
+
+// Release frees the snapshot such that the datafiles it references can be merged again. Calling
+// Release multiple times is safe.
+func (s *Snapshot) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.released {
+		return
+	}
+	s.released = true
+	s.entries = nil
+
+	s.db.pinnedMutex.Lock()
+	defer s.db.pinnedMutex.Unlock()
+
+	for _, id := range s.files {
+		s.db.pinned[id]--
+		if s.db.pinned[id] == 0 {
+			delete(s.db.pinned, id)
+		}
+	}
+}
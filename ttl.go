@@ -0,0 +1,77 @@
+package bitcask
+
+import (
+	"errors"
+	"time"
+
+	"github.com/nireo/bitcask/datafile"
+)
+
+var (
+	ErrInvalidTTL = errors.New("the ttl needs to be positive")
+)
+
+// now returns the current unix time in the same format as the expiry times.
+func now() uint32 {
+	return uint32(time.Now().Unix())
+}
+
+// PutWithTTL works like Put, but the key expires after ttl has passed. Expired keys are not found
+// by Get and the iteration functions. The expiry time is stored in seconds and it is rounded up,
+// so the key can live up to a second longer than ttl.
+func (db *DB) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+
+	current := time.Now()
+	expiry := current.Add(ttl + time.Second - 1).Unix()
+
+	return db.write([]*datafile.Entry{{
+		Timestamp: uint32(current.Unix()),
+		Key:       key,
+		Value:     value,
+		Expiry:    uint32(expiry),
+	}})
+}
+
+// runSweeper removes the expired keys from the key directory every ExpirySweepInterval until the
+// database is closed.
+func (db *DB) runSweeper() {
+	defer db.wg.Done()
+
+	ticker := time.NewTicker(db.Options.ExpirySweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.closed:
+			return
+		case <-ticker.C:
+			db.removeExpired()
+		}
+	}
+}
+
+// removeExpired removes the keys that have expired from the key directory. The expired entries are
+// left in the datafiles and they are dropped once the datafiles are merged.
+func (db *DB) removeExpired() {
+	// the key directory is scanned without the database lock, so the write lock is only held while
+	// the keys are removed.
+	current := now()
+	keys := db.KeyDir.ExpiredKeys(current)
+	if len(keys) == 0 {
+		return
+	}
+
+	db.rwmutex.Lock()
+	defer db.rwmutex.Unlock()
+
+	for _, key := range keys {
+		// the key might have been written to after it was found.
+		if entry := db.KeyDir.Get(key); entry != nil && entry.Expired(current) {
+			db.uncache(key)
+			db.KeyDir.Delete(key)
+		}
+	}
+}
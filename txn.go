@@ -0,0 +1,137 @@
+package bitcask
+
+import (
+	"errors"
+	"time"
+
+	"github.com/nireo/bitcask/datafile"
+	"github.com/nireo/bitcask/keydir"
+)
+
+var (
+	ErrConflict = errors.New("a key read by the transaction was changed by another write")
+	ErrTxnDone  = errors.New("the transaction has already been committed or discarded")
+)
+
+// Txn is an optimistic transaction. The writes are buffered in memory until Commit, which fails
+// with ErrConflict if any of the keys read by the transaction have been written to since they
+// were read. A merge that moves a read key also counts as a change, so the transaction should
+// simply be retried on ErrConflict.
+type Txn struct {
+	db *DB
+
+	// reads contains the key directory entries the transaction saw. A nil entry means that the
+	// key didn't exist.
+	reads map[string]*keydir.MemEntry
+
+	// writes contains the latest write to each key and order the order in which the keys were
+	// first written.
+	writes map[string]*datafile.Entry
+	order  []string
+
+	done bool
+}
+
+// Begin starts a new transaction.
+func (db *DB) Begin() *Txn {
+	return &Txn{
+		db:     db,
+		reads:  make(map[string]*keydir.MemEntry),
+		writes: make(map[string]*datafile.Entry),
+	}
+}
+
+// Get returns the value of a key. The writes of the transaction itself are visible.
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if txn.done {
+		return nil, ErrTxnDone
+	}
+
+	if entry, ok := txn.writes[string(key)]; ok {
+		if entry.Tombstone {
+			return nil, ErrKeyNotFound
+		}
+
+		return append([]byte(nil), entry.Value...), nil
+	}
+
+	value, entry, err := txn.db.get(key)
+	if err != nil && err != ErrKeyNotFound {
+		return nil, err
+	}
+
+	// only the first read is recorded, since the key needs to be unchanged from that point on.
+	if _, ok := txn.reads[string(key)]; !ok {
+		txn.reads[string(key)] = entry
+	}
+
+	return value, err
+}
+
+// Put buffers a write of a key-value pair into the transaction.
+func (txn *Txn) Put(key, value []byte) error {
+	return txn.set(&datafile.Entry{
+		Key:   append([]byte(nil), key...),
+		Value: append([]byte(nil), value...),
+		Batch: true,
+	})
+}
+
+// Delete buffers the deletion of a key into the transaction.
+func (txn *Txn) Delete(key []byte) error {
+	return txn.set(&datafile.Entry{
+		Key:       append([]byte(nil), key...),
+		Tombstone: true,
+		Batch:     true,
+	})
+}
+
+func (txn *Txn) set(entry *datafile.Entry) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+
+	// the limits are checked here as well, so the caller sees the error at the write that caused it.
+	if err := txn.db.checkEntries([]*datafile.Entry{entry}); err != nil {
+		return err
+	}
+
+	if _, ok := txn.writes[string(entry.Key)]; !ok {
+		txn.order = append(txn.order, string(entry.Key))
+	}
+	txn.writes[string(entry.Key)] = entry
+
+	return nil
+}
+
+// Commit writes all of the buffered writes atomically. ErrConflict is returned and nothing is
+// written if a key the transaction read has changed.
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.done = true
+
+	// a read-only transaction doesn't need to write anything.
+	if len(txn.writes) == 0 {
+		return nil
+	}
+
+	timestamp := uint32(time.Now().Unix())
+	entries := make([]*datafile.Entry, 0, len(txn.order)+1)
+	for _, key := range txn.order {
+		entry := txn.writes[key]
+		entry.Timestamp = timestamp
+		entries = append(entries, entry)
+	}
+	entries = append(entries, datafile.CommitEntry(len(txn.order), timestamp))
+
+	return txn.db.writeChecked(entries, txn.reads)
+}
+
+// Discard drops the buffered writes of the transaction.
+func (txn *Txn) Discard() {
+	txn.done = true
+	txn.writes = nil
+	txn.reads = nil
+}
@@ -19,6 +19,18 @@ func CreateDirectoryIfNotExist(directory string) error {
 	return nil
 }
 
+// SyncDirectory flushes the directory entries to the disk. This needs to be done after creating
+// or renaming files, since syncing the file itself doesn't make the file name durable.
+func SyncDirectory(directory string) error {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
 // CopyFile takes in a path where to copy from and creates a file at path dst
 func CopyFile(src, dst string) (int64, error) {
 	sourceFileStat, err := os.Stat(src)
@@ -0,0 +1,195 @@
+package bitcask
+
+import (
+	"errors"
+
+	"github.com/nireo/bitcask/datafile"
+	"github.com/nireo/bitcask/keydir"
+)
+
+// maxWriteGroup is the maximum amount of write requests that are committed together.
+const maxWriteGroup = 256
+
+var (
+	ErrClosed = errors.New("the database is closed")
+)
+
+// writeRequest contains the entries of a single Put, Delete, Write or transaction commit. The writer
+// goroutine commits multiple requests at once and then sends the result to done.
+type writeRequest struct {
+	entries []*datafile.Entry
+	done    chan error
+
+	// reads contains the key directory entries a transaction read. The request is only written if
+	// none of the keys have changed.
+	reads map[string]*keydir.MemEntry
+	err   error
+}
+
+// write queues the entries to the writer goroutine and waits until they have been committed.
+func (db *DB) write(entries []*datafile.Entry) error {
+	return db.writeChecked(entries, nil)
+}
+
+// writeChecked works like write, but the entries are only written if the key directory still
+// contains the given entries for each of the keys. Otherwise ErrConflict is returned.
+func (db *DB) writeChecked(entries []*datafile.Entry, reads map[string]*keydir.MemEntry) error {
+	if err := db.checkEntries(entries); err != nil {
+		return err
+	}
+
+	// the values are compressed and encrypted before they are queued, so the writer doesn't hold
+	// the database lock while doing it.
+	for _, entry := range entries {
+		value, codec, err := datafile.CompressValue(entry, db.Options.Compression, db.Options.CompressionThreshold)
+		if err != nil {
+			return err
+		}
+		entry.Value, entry.Codec = value, codec
+
+		if err := entry.Seal(db.cipher); err != nil {
+			return err
+		}
+	}
+
+	req := &writeRequest{
+		entries: entries,
+		reads:   reads,
+		done:    make(chan error, 1),
+	}
+
+	select {
+	case db.writes <- req:
+	case <-db.closed:
+		return ErrClosed
+	}
+
+	return <-req.done
+}
+
+// runWriter commits the queued write requests until the database is closed. All of the requests
+// that are waiting when the writer is free are written to the datafile with a single write and a
+// single sync, so concurrent writers don't each have to wait for the disk.
+func (db *DB) runWriter() {
+	defer db.wg.Done()
+
+	for {
+		var group []*writeRequest
+		select {
+		case <-db.closed:
+			return
+		case req := <-db.writes:
+			group = append(group, req)
+		}
+
+	collect:
+		for len(group) < maxWriteGroup {
+			select {
+			case req := <-db.writes:
+				group = append(group, req)
+			default:
+				break collect
+			}
+		}
+
+		err := db.commit(group)
+		for _, req := range group {
+			if req.err == nil {
+				req.err = err
+			}
+			req.done <- req.err
+		}
+	}
+}
+
+// commit writes the entries of all of the requests into the writable datafile and then updates
+// the key directory. Requests that conflict with an earlier write get ErrConflict as their error
+// and are left out. The write and the sync are done without the database lock, since only the
+// writer goroutine appends to the writable datafile and the readers can't see the new entries
+// before the key directory has been updated.
+func (db *DB) commit(group []*writeRequest) error {
+	entries, wfile, err := db.prepareCommit(group)
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+
+	mementries, err := wfile.AppendEntries(entries)
+	if err != nil {
+		return err
+	}
+
+	if db.Options.SyncPolicy == SyncAlways {
+		if err := wfile.SyncData(); err != nil {
+			return err
+		}
+	}
+
+	db.rwmutex.Lock()
+	defer db.rwmutex.Unlock()
+
+	for i, entry := range entries {
+		if entry.Commit {
+			continue
+		}
+
+		// the previous value can't be read anymore, so there is no reason to keep it cached.
+		db.uncache(string(entry.Key))
+
+		if entry.Tombstone {
+			db.KeyDir.DeleteWithTombstone(string(entry.Key), mementries[i].FileID)
+			continue
+		}
+
+		db.KeyDir.Put(string(entry.Key), mementries[i])
+	}
+
+	return nil
+}
+
+// prepareCommit collects the entries of the requests that don't conflict and rotates the
+// writable datafile if needed. It returns the entries and the datafile they are written to.
+func (db *DB) prepareCommit(group []*writeRequest) ([]*datafile.Entry, *datafile.Datafile, error) {
+	db.rwmutex.Lock()
+	defer db.rwmutex.Unlock()
+
+	// written contains the keys written by the earlier requests in the group, since they are not
+	// in the key directory yet.
+	written := make(map[string]bool)
+
+	var entries []*datafile.Entry
+	for _, req := range group {
+		if db.conflicts(req.reads, written) {
+			req.err = ErrConflict
+			continue
+		}
+
+		for _, entry := range req.entries {
+			if !entry.Commit {
+				written[string(entry.Key)] = true
+			}
+		}
+		entries = append(entries, req.entries...)
+	}
+
+	if len(entries) == 0 {
+		return nil, nil, nil
+	}
+
+	if err := db.rotateWritableFile(); err != nil {
+		return nil, nil, err
+	}
+
+	return entries, db.WFile, nil
+}
+
+// conflicts checks if any of the keys read by a transaction have been written to since they were
+// read. The caller needs to hold the write lock.
+func (db *DB) conflicts(reads map[string]*keydir.MemEntry, written map[string]bool) bool {
+	for key, entry := range reads {
+		if written[key] || !db.KeyDir.Get(key).Equal(entry) {
+			return true
+		}
+	}
+
+	return false
+}